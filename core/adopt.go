@@ -0,0 +1,421 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kobolog/gorb/pulse"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// adopt imports virtual services and backends found in IPVS, e.g. left by
+// the previous GORB run, so that they can be managed instead of conflicting
+// with new ones. Adopted backends are checked with the given pulse options,
+// or not at all if they're nil, since IPVS has no idea about health checks.
+func (ctx *Context) adopt(check *pulse.Options) error {
+	services, err := ctx.ipvs.GetServices()
+	if err != nil {
+		return err
+	}
+
+	for i := range services {
+		svc := &services[i]
+		vsID, opts := svc.id(), svc.options()
+
+		if err := opts.Validate(ctx.endpoint); err != nil {
+			log.Warnf("unable to adopt virtual service [%s]: %s", vsID, err)
+			continue
+		}
+
+		log.Infof("adopting virtual service [%s] on %s", vsID, opts.endpoint())
+
+		vs := &service{options: opts, adopted: true}
+
+		ctx.services[vsID] = vs
+		ctx.events.publish(Event{Type: EventServiceCreated, VsID: vsID})
+
+		if opts.FwMark == 0 {
+			if err := ctx.disco.Expose(vsID, opts.host.String(), opts.Port); err != nil {
+				log.Errorf("error while exposing service to Disco: %s", err)
+			}
+		}
+
+		for j := range svc.Dests {
+			dest := &svc.Dests[j]
+			rsID, opts := dest.id(vsID), dest.options()
+
+			if check != nil {
+				// Every backend has its own copy, since validation modifies it.
+				pulseOptions := *check
+				opts.Pulse = &pulseOptions
+			}
+
+			if err := opts.Validate(); err != nil {
+				log.Warnf("unable to adopt backend [%s]: %s", rsID, err)
+				continue
+			}
+
+			// Validation replaces zero weights with the default one.
+			opts.Weight, opts.VsID = dest.Weight, vsID
+
+			cid := checkID(opts.host.String(), opts.Port, opts.Pulse)
+			p, err := ctx.newCheck(cid, opts)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("adopting backend [%s] on %s:%d for virtual service [%s]",
+				rsID, opts.host, opts.Port, vsID)
+
+			rs := &backend{options: opts, service: vs, check: cid, adopted: true}
+
+			ctx.backends[rsID] = rs
+			ctx.events.publish(backendEvent(EventBackendCreated, vsID, rsID, opts.Weight))
+
+			ctx.attachCheck(pulse.ID{VsID: vsID, RsID: rsID}, rs, p)
+		}
+	}
+
+	return nil
+}
+
+// watchDrift periodically checks IPVS for changes made behind GORB's back.
+func (ctx *Context) watchDrift(interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := ctx.checkDrift(repair); err != nil {
+				log.Errorf("error while checking IPVS for drift: %s", err)
+			}
+		case <-ctx.stopCh:
+			return
+		}
+	}
+}
+
+// checkDrift compares IPVS with the virtual services and backends known to
+// the Context and returns the number of differences, which are reverted if
+// repair is set.
+func (ctx *Context) checkDrift(repair bool) (int, error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	services, err := ctx.ipvs.GetServices()
+	if err != nil {
+		return 0, err
+	}
+
+	unknown := make(map[string]*IpvsService, len(services))
+
+	for i := range services {
+		unknown[services[i].key()] = &services[i]
+	}
+
+	backends := make(map[*service]map[string]*backend)
+
+	for rsID, rs := range ctx.backends {
+		if backends[rs.service] == nil {
+			backends[rs.service] = make(map[string]*backend)
+		}
+
+		backends[rs.service][rsID] = rs
+	}
+
+	drift := 0
+
+	for vsID, vs := range ctx.services {
+		key := ipvsKey(vs.options.FwMark, uint16(vs.options.family()), vs.options.protocol,
+			vs.options.host.String(), vs.options.Port)
+
+		svc, exists := unknown[key]
+		delete(unknown, key)
+
+		if !exists {
+			drift++
+			log.Warnf("virtual service [%s] is missing from IPVS", vsID)
+
+			if !repair {
+				continue
+			}
+
+			if err := ctx.addService(vs.options); err != nil {
+				log.Errorf("error while restoring virtual service [%s]: %s", vsID, err)
+				continue
+			}
+
+			svc = &IpvsService{}
+		} else if diff := serviceDrift(vs.options, svc); len(diff) != 0 {
+			drift++
+			log.Warnf("virtual service [%s] has %s in IPVS", vsID, diff)
+
+			if repair {
+				// Services can't be edited, so the service is re-created
+				// along with its backends.
+				ctx.recreateService(vsID, vs, backends[vs])
+				continue
+			}
+		}
+
+		dests := make(map[string]*IpvsDest, len(svc.Dests))
+
+		for i := range svc.Dests {
+			dests[destKey(svc.Dests[i].IP, svc.Dests[i].Port)] = &svc.Dests[i]
+		}
+
+		for rsID, rs := range backends[vs] {
+			key := destKey(rs.options.host.String(), rs.options.Port)
+
+			dest, exists := dests[key]
+			delete(dests, key)
+
+			if !exists {
+				drift++
+				log.Warnf("backend [%s/%s] is missing from IPVS", vsID, rsID)
+
+				if repair {
+					if err := ctx.addDest(vs.options, rs.options, rs.options.Weight); err != nil {
+						log.Errorf("error while restoring backend [%s/%s]: %s", vsID, rsID, err)
+					}
+				}
+			} else if dest.Weight != rs.options.Weight || dest.Fwd != rs.options.methodID {
+				drift++
+				log.Warnf("backend [%s/%s] has weight %d and forwarding method %d in IPVS instead of %d and %d",
+					vsID, rsID, dest.Weight, dest.Fwd, rs.options.Weight, rs.options.methodID)
+
+				if repair {
+					if err := ctx.updateDest(vs.options, rs.options, rs.options.Weight); err != nil {
+						log.Errorf("error while restoring backend [%s/%s]: %s", vsID, rsID, err)
+					}
+				}
+			}
+		}
+
+		for key, dest := range dests {
+			drift++
+			log.Warnf("unknown backend %s of virtual service [%s] in IPVS", key, vsID)
+
+			if repair {
+				if err := ctx.delDest(vs.options, &BackendOptions{
+					host: net.ParseIP(dest.IP), Port: dest.Port}); err != nil {
+					log.Errorf("error while removing backend %s of virtual service [%s]: %s", key, vsID, err)
+				}
+			}
+		}
+	}
+
+	for key, svc := range unknown {
+		drift++
+		log.Warnf("unknown virtual service %s in IPVS", key)
+
+		if repair {
+			if err := ctx.delService(&ServiceOptions{FwMark: svc.FwMark, af: svc.AF,
+				host: net.ParseIP(svc.VIP), Port: svc.Port, protocol: svc.Protocol}); err != nil {
+				log.Errorf("error while removing virtual service %s: %s", key, err)
+			}
+		}
+	}
+
+	return drift, nil
+}
+
+// recreateService replaces the virtual service in IPVS with one matching its
+// options. Must be called with the Context locked.
+func (ctx *Context) recreateService(vsID string, vs *service, backends map[string]*backend) {
+	if err := ctx.delService(vs.options); err != nil {
+		log.Errorf("error while removing virtual service [%s]: %s", vsID, err)
+		return
+	}
+
+	if err := ctx.addService(vs.options); err != nil {
+		log.Errorf("error while restoring virtual service [%s]: %s", vsID, err)
+		return
+	}
+
+	for rsID, rs := range backends {
+		if err := ctx.addDest(vs.options, rs.options, rs.options.Weight); err != nil {
+			log.Errorf("error while restoring backend [%s/%s]: %s", vsID, rsID, err)
+		}
+	}
+}
+
+// serviceDrift describes how the virtual service in IPVS differs from its
+// options, if it does.
+func serviceDrift(opts *ServiceOptions, svc *IpvsService) string {
+	var r []string
+
+	if svc.Sched != opts.Method {
+		r = append(r, fmt.Sprintf("scheduler %s instead of %s", svc.Sched, opts.Method))
+	}
+
+	// IPVS marks every service as hashed.
+	if flags := svc.Flags &^ gnl2go.IP_VS_SVC_F_HASHED; flags != opts.ipvsFlags() {
+		r = append(r, fmt.Sprintf("flags %#x instead of %#x", flags, opts.ipvsFlags()))
+	} else if opts.Persistent {
+		if timeout := uint32(opts.persistenceTimeout / time.Second); svc.Timeout != timeout {
+			r = append(r, fmt.Sprintf("persistence timeout %ds instead of %ds", svc.Timeout, timeout))
+		}
+
+		if netmask := svc.netmask(); netmask != opts.PersistenceNetmask {
+			r = append(r, fmt.Sprintf("persistence netmask /%d instead of /%d", netmask, opts.PersistenceNetmask))
+		}
+	}
+
+	return strings.Join(r, ", ")
+}
+
+// ipvsKey identifies the virtual service in IPVS.
+func ipvsKey(fwmark uint32, af, protocol uint16, vip string, port uint16) string {
+	if fwmark != 0 {
+		return fmt.Sprintf("fwmark %d (%s)", fwmark, familyName(af))
+	}
+
+	return fmt.Sprintf("%s %s", protocolName(protocol), destKey(vip, port))
+}
+
+func (s *IpvsService) key() string {
+	return ipvsKey(s.FwMark, s.AF, s.Protocol, s.VIP, s.Port)
+}
+
+// id generates the ID of the adopted virtual service, which is the same
+// every time it's adopted.
+func (s *IpvsService) id() string {
+	if s.FwMark != 0 {
+		return fmt.Sprintf("fwmark-%d-%s", s.FwMark, familyName(s.AF))
+	}
+
+	return fmt.Sprintf("%s-%s-%d", protocolName(s.Protocol), s.VIP, s.Port)
+}
+
+// options converts the virtual service back to its configuration.
+func (s *IpvsService) options() *ServiceOptions {
+	if s.FwMark != 0 {
+		return &ServiceOptions{FwMark: s.FwMark, Family: familyName(s.AF), Method: s.Sched}
+	}
+
+	opts := &ServiceOptions{
+		Host:     s.VIP,
+		Port:     s.Port,
+		Protocol: protocolName(s.Protocol),
+		Method:   s.Sched,
+		Flags:    flagNames(s.Sched, s.Flags),
+	}
+
+	if s.Flags&gnl2go.IP_VS_SVC_F_PERSISTENT != 0 {
+		opts.Persistent = true
+		opts.PersistenceTimeout = fmt.Sprintf("%ds", s.Timeout)
+		opts.PersistenceNetmask = s.netmask()
+	}
+
+	return opts
+}
+
+// netmask returns the persistence netmask prefix length.
+func (s *IpvsService) netmask() int {
+	if s.AF != syscall.AF_INET {
+		return int(s.Netmask)
+	}
+
+	// IPv4 netmasks are masks rather than prefix lengths.
+	mask := make(net.IPMask, net.IPv4len)
+	nl.NativeEndian().PutUint32(mask, s.Netmask)
+	ones, _ := mask.Size()
+
+	return ones
+}
+
+// id generates the ID of the adopted backend, which is unique across
+// virtual services.
+func (d *IpvsDest) id(vsID string) string {
+	return fmt.Sprintf("%s-%s-%d", vsID, d.IP, d.Port)
+}
+
+// options converts the backend back to its configuration.
+func (d *IpvsDest) options() *BackendOptions {
+	return &BackendOptions{
+		Host:   d.IP,
+		Port:   d.Port,
+		Weight: d.Weight,
+		Method: methodName(d.Fwd),
+		Pulse:  &pulse.Options{Type: "none"},
+	}
+}
+
+func protocolName(protocol uint16) string {
+	switch protocol {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	default:
+		return fmt.Sprintf("proto-%d", protocol)
+	}
+}
+
+func familyName(af uint16) string {
+	if af == syscall.AF_INET6 {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
+
+func methodName(fwd uint32) string {
+	switch fwd {
+	case gnl2go.IPVS_MASQUERADING:
+		return "nat"
+	case gnl2go.IPVS_TUNNELING:
+		return "tunnel"
+	case gnl2go.IPVS_DIRECTROUTE:
+		return "dr"
+	default:
+		return fmt.Sprintf("fwd-%d", fwd)
+	}
+}
+
+// flagNames converts scheduler flags back to their names.
+func flagNames(sched string, flags uint32) string {
+	names := []string{"flag-1", "flag-2", "flag-3"}
+
+	if sched == "sh" {
+		names = []string{"sh-fallback", "sh-port", "flag-3"}
+	}
+
+	var r []string
+
+	for _, name := range names {
+		if flags&uint32(schedulerFlags[name]) != 0 {
+			r = append(r, name)
+		}
+	}
+
+	return strings.Join(r, "|")
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/kobolog/gorb/pulse"
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sharedCheck is a Pulse shared by all backends with the same address and
+// pulse options, so that they are probed once and have the same health.
+type sharedCheck struct {
+	pulse    *pulse.Pulse
+	backends map[pulse.ID]struct{}
+
+	// Last reported metrics, if any, for backends attached later on.
+	metrics *pulse.Metrics
+}
+
+// checkID identifies the check of the given target with the given options.
+func checkID(host string, port uint16, opts *pulse.Options) pulse.ID {
+	digest := sha256.Sum256(util.MustMarshal(opts, util.JSONOptions{}))
+
+	return pulse.ID{
+		VsID: fmt.Sprintf("%s:%d", host, port),
+		RsID: hex.EncodeToString(digest[:])}
+}
+
+// newCheck builds the Pulse of the backend's check, or returns nil if the
+// check is already shared by other backends. Must be called with the Context
+// locked.
+func (ctx *Context) newCheck(cid pulse.ID, opts *BackendOptions) (*pulse.Pulse, error) {
+	if _, exists := ctx.checks[cid]; exists {
+		return nil, nil
+	}
+
+	return pulse.New(opts.host.String(), opts.Port, opts.Pulse)
+}
+
+// attachCheck sets the Pulse checking the backend. The given Pulse, built by
+// newCheck, is started only if the check isn't already shared by other
+// backends. Must be called with the Context locked.
+func (ctx *Context) attachCheck(id pulse.ID, rs *backend, p *pulse.Pulse) {
+	if check, exists := ctx.checks[rs.check]; exists {
+		log.Infof("backend %s shares the pulse of %s", id, rs.check.VsID)
+
+		check.backends[id] = struct{}{}
+		rs.monitor = check.pulse
+
+		if check.metrics != nil {
+			// The backend has the same health as the others right away. The
+			// check itself has been observed already.
+			ctx.setPulseMetrics(ctx.stash, pulse.Update{Source: id, Metrics: *check.metrics})
+		}
+
+		return
+	}
+
+	ctx.checks[rs.check] = &sharedCheck{pulse: p, backends: map[pulse.ID]struct{}{id: {}}}
+	rs.monitor = p
+
+	if ctx.scheduler != nil {
+		ctx.scheduler.Add(rs.check, p)
+	} else {
+		// Fire off the configured pulse goroutine, attach it to the Context.
+		go p.Loop(rs.check, ctx.pulseCh, ctx.stopCh)
+	}
+}
+
+// detachCheck stops the backend's Pulse, unless other backends still share
+// it. Must be called with the Context locked.
+func (ctx *Context) detachCheck(id, cid pulse.ID) {
+	check, exists := ctx.checks[cid]
+
+	if !exists {
+		return
+	}
+
+	delete(check.backends, id)
+
+	if len(check.backends) == 0 {
+		// Stop the pulse goroutine.
+		check.pulse.Stop()
+		delete(ctx.checks, cid)
+	}
+}
+
+// fanOut returns the updates of the check for each backend sharing it.
+// Updates of unknown checks are passed through as is. Must be called with
+// the Context locked.
+func (ctx *Context) fanOut(u pulse.Update) []pulse.Update {
+	check, exists := ctx.checks[u.Source]
+
+	if !exists {
+		return []pulse.Update{u}
+	}
+
+	if u.Metrics.Status == pulse.StatusRemoved {
+		// Checks are stopped once no backends share them, so this is a late
+		// update of a previous check with the same ID.
+		return nil
+	}
+
+	check.metrics = &u.Metrics
+
+	r := make([]pulse.Update, 0, len(check.backends))
+
+	for id := range check.backends {
+		r = append(r, pulse.Update{Source: id, Metrics: u.Metrics})
+	}
+
+	return r
+}
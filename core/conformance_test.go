@@ -0,0 +1,128 @@
+package core
+
+import (
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// testIpvsConformance checks that the Ipvs implementation behaves like the
+// kernel one, starting with empty IPVS.
+func testIpvsConformance(t *testing.T, ipvs Ipvs) {
+	require.NoError(t, ipvs.Flush())
+	defer ipvs.Flush()
+
+	tcp, udp := uint16(syscall.IPPROTO_TCP), uint16(syscall.IPPROTO_UDP)
+
+	// Virtual services.
+	assert.NoError(t, ipvs.AddService("10.0.0.1", 80, tcp, "wrr"))
+	assert.Equal(t, syscall.EEXIST, ipvs.AddService("10.0.0.1", 80, tcp, "rr"))
+	assert.NoError(t, ipvs.AddServiceWithFlags("10.0.0.1", 81, tcp, "sh",
+		ipvsFlags(ipvsSvcFlagSched2)))
+	assert.NoError(t, ipvs.AddServiceWithPersistence("10.0.0.1", 82, tcp, "wrr",
+		ipvsFlags(ipvsSvcFlagPersistent), 300, 24))
+	assert.NoError(t, ipvs.AddService("fd00::1", 53, udp, "rr"))
+	assert.NoError(t, ipvs.AddFWMService(7, "wrr", syscall.AF_INET))
+	assert.Equal(t, syscall.EEXIST, ipvs.AddFWMService(7, "rr", syscall.AF_INET))
+
+	// Backends.
+	assert.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, tcp, 100, ipvsConnFwdMasq))
+	assert.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.2", 8080, tcp, 0, ipvsConnFwdMasq))
+	assert.Equal(t, syscall.EEXIST,
+		ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, tcp, 50, ipvsConnFwdMasq))
+	assert.Equal(t, syscall.ESRCH,
+		ipvs.AddDestPort("10.0.0.1", 90, "10.1.0.1", 8080, tcp, 100, ipvsConnFwdMasq))
+	assert.NoError(t, ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.1", 8080, tcp, 50, ipvsConnFwdRoute))
+	assert.Equal(t, syscall.ENOENT,
+		ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.3", 8080, tcp, 50, ipvsConnFwdMasq))
+	assert.Equal(t, syscall.ERANGE,
+		ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.3", 8080, tcp, -1, ipvsConnFwdMasq))
+	assert.Equal(t, syscall.ERANGE,
+		ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.1", 8080, tcp, -1, ipvsConnFwdMasq))
+	assert.NoError(t, ipvs.AddDestPort("fd00::1", 53, "fd00::2", 5353, udp, 10, ipvsConnFwdTunnel))
+	assert.NoError(t, ipvs.AddFWMDestFWD(7, "10.1.0.1", syscall.AF_INET, 0, 10, ipvsConnFwdRoute))
+	assert.NoError(t, ipvs.UpdateFWMDestFWD(7, "10.1.0.1", syscall.AF_INET, 0, 20, ipvsConnFwdRoute))
+	assert.Equal(t, syscall.ENOENT,
+		ipvs.UpdateFWMDestFWD(7, "10.1.0.2", syscall.AF_INET, 0, 20, ipvsConnFwdRoute))
+
+	services, err := ipvs.GetServices()
+	require.NoError(t, err)
+
+	found := make(map[string]IpvsService)
+
+	for _, svc := range services {
+		// The kernel marks services in its table as hashed.
+		svc.Flags &^= ipvsSvcFlagHashed
+
+		// Backends are listed in no particular order.
+		sort.Slice(svc.Dests, func(i, j int) bool {
+			return destKey(svc.Dests[i].IP, svc.Dests[i].Port) < destKey(svc.Dests[j].IP, svc.Dests[j].Port)
+		})
+
+		found[svc.key()] = svc
+	}
+
+	require.Len(t, found, 5)
+
+	assert.Equal(t, "wrr", found["tcp 10.0.0.1:80"].Sched)
+	assert.Equal(t, []IpvsDest{
+		{IP: "10.1.0.1", Port: 8080, Weight: 50, Fwd: ipvsConnFwdRoute},
+		{IP: "10.1.0.2", Port: 8080, Weight: 0, Fwd: ipvsConnFwdMasq},
+	}, found["tcp 10.0.0.1:80"].Dests)
+
+	assert.Equal(t, uint32(ipvsSvcFlagSched2), found["tcp 10.0.0.1:81"].Flags)
+
+	persistent := found["tcp 10.0.0.1:82"]
+	assert.Equal(t, uint32(ipvsSvcFlagPersistent), persistent.Flags)
+	assert.Equal(t, uint32(300), persistent.Timeout)
+	assert.Equal(t, nl.NativeEndian().Uint32(net.CIDRMask(24, 32)), persistent.Netmask)
+
+	assert.Equal(t, IpvsService{AF: syscall.AF_INET6, Protocol: udp, VIP: "fd00::1", Port: 53, Sched: "rr",
+		Netmask: 128, Dests: []IpvsDest{{IP: "fd00::2", Port: 5353, Weight: 10, Fwd: ipvsConnFwdTunnel}}},
+		found["udp [fd00::1]:53"])
+
+	assert.Equal(t, []IpvsDest{{IP: "10.1.0.1", Port: 0, Weight: 20, Fwd: ipvsConnFwdRoute}},
+		found["fwmark 7 (ipv4)"].Dests)
+
+	// Stats.
+	stats, err := ipvs.GetServiceStats("10.0.0.1", 80, tcp)
+	require.NoError(t, err)
+	assert.Len(t, stats.Dests, 2)
+	assert.Contains(t, stats.Dests, "10.1.0.1:8080")
+
+	stats, err = ipvs.GetFWMServiceStats(7, syscall.AF_INET)
+	require.NoError(t, err)
+	assert.Contains(t, stats.Dests, "10.1.0.1:0")
+
+	_, err = ipvs.GetServiceStats("10.0.0.1", 90, tcp)
+	assert.Equal(t, syscall.ESRCH, err)
+
+	// Removal.
+	assert.NoError(t, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.2", 8080, tcp))
+	assert.Equal(t, syscall.ENOENT, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.2", 8080, tcp))
+	assert.NoError(t, ipvs.DelFWMDest(7, "10.1.0.1", syscall.AF_INET, 0))
+	assert.Equal(t, syscall.ENOENT, ipvs.DelFWMDest(7, "10.1.0.1", syscall.AF_INET, 0))
+	assert.NoError(t, ipvs.DelService("10.0.0.1", 80, tcp))
+	assert.Equal(t, syscall.ESRCH, ipvs.DelService("10.0.0.1", 80, tcp))
+	assert.NoError(t, ipvs.DelFWMService(7, syscall.AF_INET))
+	assert.Equal(t, syscall.ESRCH, ipvs.DelFWMService(7, syscall.AF_INET))
+
+	services, err = ipvs.GetServices()
+	require.NoError(t, err)
+	assert.Len(t, services, 3)
+
+	require.NoError(t, ipvs.Flush())
+
+	services, err = ipvs.GetServices()
+	require.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestMemoryIpvsConformance(t *testing.T) {
+	testIpvsConformance(t, newMemoryIpvs())
+}
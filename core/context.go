@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/kobolog/gorb/disco"
 	"github.com/kobolog/gorb/pulse"
@@ -33,7 +34,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/tehnerd/gnl2go"
-	"strings"
 )
 
 // Possible runtime errors.
@@ -49,17 +49,47 @@ var (
 	ErrObjectExists = errors.New("specified object already exists")
 	ErrObjectNotFound = errors.New("unable to locate specified object")
 	ErrIncompatibleAFs = errors.New("incompatible address families")
+	ErrUnknownIpvsDriver = errors.New("unknown IPVS driver")
 )
 
 type service struct {
 	options *ServiceOptions
+
+	// Adopted from IPVS rather than created through the API or the store.
+	adopted bool
 }
 
 type backend struct {
 	options *BackendOptions
 	service *service
 	monitor *pulse.Pulse
+	check   pulse.ID
 	metrics pulse.Metrics
+
+	// Weight ramp-up in progress, if any.
+	ramp *ramp
+
+	// Weight restored once a drained backend or one under maintenance
+	// becomes active again.
+	restore int32
+
+	// Adopted from IPVS rather than created through the API or the store.
+	adopted bool
+}
+
+// slowStart returns the backend's slow start duration, which defaults to
+// the virtual service one.
+func (rs *backend) slowStart() time.Duration {
+	if rs.options.slowStart != 0 {
+		return rs.options.slowStart
+	}
+
+	return rs.service.options.slowStart
+}
+
+// active returns whether the backend is in rotation.
+func (rs *backend) active() bool {
+	return rs.options.State != StateDrain && rs.options.State != StateMaintenance
 }
 
 // Context abstacts away the underlying IPVS bindings implementation.
@@ -70,10 +100,17 @@ type Context struct {
 	backends     map[string]*backend
 	mutex        sync.RWMutex
 	pulseCh      chan pulse.Update
+	batchCh      chan []pulse.Update
+	scheduler    *pulse.Scheduler
+	checks       map[pulse.ID]*sharedCheck
+	stash        map[pulse.ID]int32
 	disco        disco.Driver
 	stopCh       chan struct{}
 	vipInterface netlink.Link
 	store        *Store
+	events       eventBus
+	webhooks     []WebhookOptions
+	notifier     *notifier
 }
 
 type Ipvs interface {
@@ -82,10 +119,20 @@ type Ipvs interface {
 	Flush() error
 	AddService(vip string, port uint16, protocol uint16, sched string) error
 	AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error
+	AddServiceWithPersistence(vip string, port uint16, protocol uint16, sched string, flags []byte,
+		timeout uint32, netmask uint32) error
 	DelService(vip string, port uint16, protocol uint16) error
 	AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error
 	UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error
 	DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error
+	AddFWMService(fwmark uint32, sched string, vaf uint16) error
+	DelFWMService(fwmark uint32, vaf uint16) error
+	AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error
+	UpdateFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error
+	DelFWMDest(fwmark uint32, rip string, vaf uint16, port uint16) error
+	GetServiceStats(vip string, port uint16, protocol uint16) (*ServiceStats, error)
+	GetFWMServiceStats(fwmark uint32, vaf uint16) (*ServiceStats, error)
+	GetServices() ([]IpvsService, error)
 }
 
 // NewContext creates a new Context and initializes IPVS.
@@ -93,13 +140,33 @@ func NewContext(options ContextOptions) (*Context, error) {
 	log.Info("initializing IPVS context")
 
 	ctx := &Context{
-		ipvs:     &gnl2go.IpvsClient{},
 		services: make(map[string]*service),
 		backends: make(map[string]*backend),
 		pulseCh:  make(chan pulse.Update),
+		batchCh:  make(chan []pulse.Update),
+		checks:   make(map[pulse.ID]*sharedCheck),
+		stash:    make(map[pulse.ID]int32),
 		stopCh:   make(chan struct{}),
 	}
 
+	switch {
+	case options.DryRun:
+		log.Info("running dry, IPVS is simulated in memory")
+		ctx.ipvs = newMemoryIpvs()
+	case options.IpvsDriver == "" || options.IpvsDriver == "gnl2go":
+		ctx.ipvs = &ipvsClient{&gnl2go.IpvsClient{}, &netlinkIpvs{}}
+	case options.IpvsDriver == "netlink":
+		ctx.ipvs = &netlinkIpvs{}
+	default:
+		return nil, ErrUnknownIpvsDriver
+	}
+
+	for i := range options.Webhooks {
+		if err := options.Webhooks[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	if len(options.Disco) > 0 {
 		log.Infof("creating Consul client with Agent URL: %s", options.Disco)
 
@@ -139,7 +206,9 @@ func NewContext(options ContextOptions) (*Context, error) {
 		return nil, ErrIpvsSyscallFailed
 	}
 
-	if options.VipInterface != "" {
+	if options.VipInterface != "" && options.DryRun {
+		log.Infof("VIPs won't be added to interface '%s' in a dry run", options.VipInterface)
+	} else if options.VipInterface != "" {
 		var err error
 		if ctx.vipInterface, err = netlink.LinkByName(options.VipInterface); err != nil {
 			ctx.Close()
@@ -150,9 +219,31 @@ func NewContext(options ContextOptions) (*Context, error) {
 		log.Infof("VIPs will be added to interface '%s'", ctx.vipInterface.Attrs().Name)
 	}
 
+	ctx.webhooks, ctx.notifier = options.Webhooks, newNotifier()
+
+	if options.PulseWorkers > 0 {
+		log.Infof("scheduling pulse checks on %d workers", options.PulseWorkers)
+
+		ctx.scheduler = pulse.NewScheduler(pulse.SchedulerOptions{
+			Workers: options.PulseWorkers,
+			Rate:    options.PulseRate}, ctx.batchCh)
+	}
+
+	if options.Adopt {
+		if err := ctx.adopt(options.AdoptPulse); err != nil {
+			log.Errorf("unable to adopt IPVS pools: %s", err)
+			ctx.Close()
+			return nil, ErrIpvsSyscallFailed
+		}
+	}
+
 	// Fire off a pulse notifications sink goroutine.
 	go ctx.run()
 
+	if options.DriftInterval > 0 {
+		go ctx.watchDrift(options.DriftInterval, options.DriftRepair)
+	}
+
 	return ctx, nil
 }
 
@@ -167,6 +258,14 @@ func (ctx *Context) Close() {
 		ctx.RemoveService(vsID)
 	}
 
+	if ctx.notifier != nil {
+		ctx.notifier.stop()
+	}
+
+	if ctx.scheduler != nil {
+		ctx.scheduler.Stop()
+	}
+
 	// This is not strictly required, as far as I know.
 	ctx.ipvs.Exit()
 }
@@ -181,7 +280,7 @@ func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 		return ErrObjectExists
 	}
 
-	if ctx.vipInterface != nil {
+	if ctx.vipInterface != nil && opts.FwMark == 0 {
 		ifName := ctx.vipInterface.Attrs().Name
 		vip := &netlink.Addr{IPNet: &net.IPNet{
 			net.ParseIP(opts.host.String()), net.IPv4Mask(255, 255, 255, 255)}}
@@ -195,8 +294,7 @@ func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 		log.Infof("VIP %s has been added to interface '%s'", opts.host, ifName)
 	}
 
-	log.Infof("creating virtual service [%s] on %s:%d", vsID, opts.host,
-		opts.Port)
+	log.Infof("creating virtual service [%s] on %s", vsID, opts.endpoint())
 
 	// create service to external store
 	if ctx.store != nil {
@@ -206,35 +304,18 @@ func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 		}
 	}
 
-	var flags int
-	for _, flag := range strings.Split(opts.Flags, "|") {
-		flags = flags | schedulerFlags[flag]
-	}
-
-	if flags != 0 {
-		if err := ctx.ipvs.AddServiceWithFlags(
-			opts.host.String(),
-			opts.Port,
-			opts.protocol,
-			opts.Method,
-			gnl2go.U32ToBinFlags(uint32(flags)),
-		); err != nil {
-			log.Errorf("error while creating virtual service: %s", err)
-			return ErrIpvsSyscallFailed
-		}
-	} else {
-		if err := ctx.ipvs.AddService(
-			opts.host.String(),
-			opts.Port,
-			opts.protocol,
-			opts.Method,
-		); err != nil {
-			log.Errorf("error while creating virtual service: %s", err)
-			return ErrIpvsSyscallFailed
-		}
+	if err := ctx.addService(opts); err != nil {
+		log.Errorf("error while creating virtual service: %s", err)
+		return ErrIpvsSyscallFailed
 	}
 
 	ctx.services[vsID] = &service{options: opts}
+	ctx.events.publish(Event{Type: EventServiceCreated, VsID: vsID})
+
+	if opts.FwMark != 0 {
+		// There's no single endpoint to expose.
+		return nil
+	}
 
 	if err := ctx.disco.Expose(vsID, opts.host.String(), opts.Port); err != nil {
 		log.Errorf("error while exposing service to Disco: %s", err)
@@ -255,7 +336,8 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 	if err := opts.Validate(); err != nil {
 		return err
 	}
-	p, err := pulse.New(opts.host.String(), opts.Port, opts.Pulse)
+	cid := checkID(opts.host.String(), opts.Port, opts.Pulse)
+	p, err := ctx.newCheck(cid, opts)
 	if err != nil {
 		return err
 	}
@@ -270,7 +352,7 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 		return ErrObjectNotFound
 	}
 
-	if util.AddrFamily(opts.host) != util.AddrFamily(vs.options.host) {
+	if util.AddrFamily(opts.host) != vs.options.family() {
 		return ErrIncompatibleAFs
 	}
 
@@ -288,23 +370,29 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 		}
 	}
 
-	if err := ctx.ipvs.AddDestPort(
-		vs.options.host.String(),
-		vs.options.Port,
-		opts.host.String(),
-		opts.Port,
-		vs.options.protocol,
-		int32(opts.Weight),
-		opts.methodID,
-	); err != nil {
+	rs := &backend{options: opts, service: vs, check: cid}
+
+	if opts.State != StateActive {
+		// The backend is out of rotation until it's activated.
+		rs.restore, opts.Weight = opts.Weight, 0
+	} else if rs.slowStart() != 0 {
+		// The backend starts with the lowest weight and ramps up over time.
+		rs.ramp = &ramp{pulse.ID{VsID: vsID, RsID: rsID}, time.Now(), opts.Weight}
+		opts.Weight = rs.ramp.current(rs.ramp.since, rs.slowStart())
+	}
+
+	if err := ctx.addDest(vs.options, opts, opts.Weight); err != nil {
 		log.Errorf("error while creating backend: %s", err)
 		return ErrIpvsSyscallFailed
 	}
 
-	ctx.backends[rsID] = &backend{options: opts, service: vs, monitor: p}
+	ctx.backends[rsID] = rs
+	ctx.events.publish(backendEvent(EventBackendCreated, vsID, rsID, opts.Weight))
 
-	// Fire off the configured pulse goroutine, attach it to the Context.
-	go ctx.backends[rsID].monitor.Loop(pulse.ID{VsID: vsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
+	if opts.State != StateMaintenance {
+		// Identical checks of backends shared across services are run once.
+		ctx.attachCheck(pulse.ID{VsID: vsID, RsID: rsID}, rs, p)
+	}
 
 	return nil
 }
@@ -327,15 +415,7 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight int32) (int32, error
 	log.Infof("updating backend [%s/%s] with weight: %d", vsID, rsID,
 		weight)
 
-	if err := ctx.ipvs.UpdateDestPort(
-		rs.service.options.host.String(),
-		rs.service.options.Port,
-		rs.options.host.String(),
-		rs.options.Port,
-		rs.service.options.protocol,
-		weight,
-		rs.options.methodID,
-	); err != nil {
+	if err := ctx.updateDest(rs.service.options, rs.options, weight); err != nil {
 		log.Errorf("error while updating backend [%s/%s]", vsID, rsID)
 		return 0, ErrIpvsSyscallFailed
 	}
@@ -345,6 +425,10 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight int32) (int32, error
 	// Save the old backend weight and update the current backend weight.
 	result, rs.options.Weight = rs.options.Weight, weight
 
+	if result != weight {
+		ctx.events.publish(backendEvent(EventBackendWeight, vsID, rsID, weight))
+	}
+
 	// Currently the backend options are changing only the weight.
 	// The weight value is set to the value requested at the first setting,
 	// and the weight value is updated when the pulse fails in the gorb.
@@ -361,9 +445,136 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight int32) (int32, error
 func (ctx *Context) UpdateBackend(vsID, rsID string, weight int32) (int32, error) {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
+
+	if rs, exists := ctx.backends[rsID]; exists && !rs.active() {
+		var result int32
+
+		// The weight is applied once the backend is active again.
+		result, rs.restore = rs.restore, weight
+
+		if result != weight {
+			e := backendEvent(EventBackendWeight, vsID, rsID, weight)
+			e.State = rs.options.State
+			ctx.events.publish(e)
+		}
+
+		if ctx.store != nil {
+			opts := *rs.options
+
+			// The store keeps the weight to restore.
+			opts.Weight = rs.restore
+
+			if err := ctx.store.UpdateBackend(vsID, rsID, &opts); err != nil {
+				log.Errorf("error while update backend : %s", err)
+			}
+		}
+
+		return result, nil
+	}
+
 	return ctx.updateBackend(vsID, rsID, weight)
 }
 
+// setBackendState changes the backend's administrative state. Backends out
+// of rotation have zero weight, which is not touched by pulse updates.
+func (ctx *Context) setBackendState(vsID, rsID, state string) error {
+	rs, exists := ctx.backends[rsID]
+
+	if !exists {
+		return ErrObjectNotFound
+	}
+
+	state, err := parseState(state)
+	if err != nil {
+		return err
+	}
+
+	prev, _ := parseState(rs.options.State)
+
+	if state == prev {
+		return nil
+	}
+
+	log.Infof("changing backend [%s/%s] state from %s to %s", vsID, rsID, prev, state)
+
+	var p *pulse.Pulse
+
+	if prev == StateMaintenance {
+		if p, err = ctx.newCheck(rs.check, rs.options); err != nil {
+			return err
+		}
+	}
+
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+
+	if prev == StateActive {
+		restore := rs.options.Weight
+
+		if rs.ramp != nil {
+			// The full weight is restored instead of the partial one.
+			restore, rs.ramp = rs.ramp.weight, nil
+		} else if weight, exists := ctx.stash[id]; exists {
+			// The live weight of failing or penalized backends isn't the full one.
+			restore = weight
+			delete(ctx.stash, id)
+		}
+
+		if _, err := ctx.updateBackend(vsID, rsID, 0); err != nil {
+			return err
+		}
+
+		rs.restore = restore
+	} else if state == StateActive {
+		weight := rs.restore
+
+		if rs.metrics.Status == pulse.StatusDown {
+			// The backend is stashed until it recovers.
+			weight, ctx.stash[id] = 0, rs.restore
+		}
+
+		if _, err := ctx.updateBackend(vsID, rsID, weight); err != nil {
+			return err
+		}
+	}
+
+	rs.options.State = state
+
+	if prev == StateMaintenance {
+		// Resume the suspended pulse.
+		ctx.attachCheck(id, rs, p)
+	} else if state == StateMaintenance {
+		ctx.detachCheck(id, rs.check)
+		rs.monitor = nil
+	}
+
+	e := backendEvent(EventBackendState, vsID, rsID, rs.options.Weight)
+	e.State = state
+	ctx.events.publish(e)
+
+	if ctx.store != nil {
+		opts := *rs.options
+
+		if state != StateActive {
+			// The store keeps the weight to restore.
+			opts.Weight = rs.restore
+		}
+
+		if err := ctx.store.UpdateBackend(vsID, rsID, &opts); err != nil {
+			log.Errorf("error while update backend : %s", err)
+		}
+	}
+
+	return nil
+}
+
+// SetBackendState changes the backend's administrative state to active,
+// drain or maintenance.
+func (ctx *Context) SetBackendState(vsID, rsID, state string) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.setBackendState(vsID, rsID, state)
+}
+
 // RemoveService deregisters a virtual service.
 func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 	vs, exists := ctx.services[vsID]
@@ -386,15 +597,9 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 		log.Infof("VIP %s has been deleted from interface '%s'", vs.options.host, ifName)
 	}
 
-	log.Infof("removing virtual service [%s] from %s:%d", vsID,
-		vs.options.host,
-		vs.options.Port)
+	log.Infof("removing virtual service [%s] from %s", vsID, vs.options.endpoint())
 
-	if err := ctx.ipvs.DelService(
-		vs.options.host.String(),
-		vs.options.Port,
-		vs.options.protocol,
-	); err != nil {
+	if err := ctx.delService(vs.options); err != nil {
 		log.Errorf("error while removing virtual service [%s]", vsID)
 		return nil, ErrIpvsSyscallFailed
 	}
@@ -413,10 +618,11 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 
 		log.Infof("cleaning up now orphaned backend [%s/%s]", vsID, rsID)
 
-		// Stop the pulse goroutine.
-		backend.monitor.Stop()
+		ctx.detachCheck(pulse.ID{VsID: vsID, RsID: rsID}, backend.check)
 
 		delete(ctx.backends, rsID)
+		forgetBackend(vsID, rsID, backend.options)
+		ctx.events.publish(backendEvent(EventBackendRemoved, vsID, rsID, backend.options.Weight))
 
 		// delete backend from external store
 		if ctx.store != nil {
@@ -424,6 +630,13 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 		}
 	}
 
+	forgetService(vsID, vs.options)
+	ctx.events.publish(Event{Type: EventServiceRemoved, VsID: vsID})
+
+	if vs.options.FwMark != 0 {
+		return vs.options, nil
+	}
+
 	// TODO(@kobolog): This will never happen in case of gorb-link.
 	if err := ctx.disco.Remove(vsID); err != nil {
 		log.Errorf("error while removing service from Disco: %s", err)
@@ -456,21 +669,16 @@ func (ctx *Context) removeBackend(vsID, rsID string) (*BackendOptions, error) {
 		}
 	}
 
-	// Stop the pulse goroutine.
-	rs.monitor.Stop()
+	ctx.detachCheck(pulse.ID{VsID: vsID, RsID: rsID}, rs.check)
 
-	if err := ctx.ipvs.DelDestPort(
-		rs.service.options.host.String(),
-		rs.service.options.Port,
-		rs.options.host.String(),
-		rs.options.Port,
-		rs.service.options.protocol,
-	); err != nil {
+	if err := ctx.delDest(rs.service.options, rs.options); err != nil {
 		log.Errorf("error while removing backend [%s/%s]", vsID, rsID)
 		return nil, ErrIpvsSyscallFailed
 	}
 
 	delete(ctx.backends, rsID)
+	forgetBackend(vsID, rsID, rs.options)
+	ctx.events.publish(backendEvent(EventBackendRemoved, vsID, rsID, rs.options.Weight))
 
 	return rs.options, nil
 }
@@ -496,12 +704,18 @@ func (ctx *Context) ListServices() ([]string, error) {
 	return r, nil
 }
 
+// IpvsTable returns virtual services and backends as seen by IPVS.
+func (ctx *Context) IpvsTable() ([]IpvsService, error) {
+	return ctx.ipvs.GetServices()
+}
+
 // ServiceInfo contains information about virtual service options,
 // its backends and overall virtual service health.
 type ServiceInfo struct {
 	Options  *ServiceOptions `json:"options"`
 	Health   float64         `json:"health"`
 	Backends []string        `json:"backends"`
+	Stats    *Stats          `json:"stats,omitempty"`
 }
 
 // GetService returns information about a virtual service.
@@ -515,6 +729,20 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 		return nil, ErrObjectNotFound
 	}
 
+	result := ctx.serviceInfo(vs)
+
+	if stats, err := ctx.serviceStats(vs.options); err == nil {
+		result.Stats = &stats.Stats
+	} else {
+		log.Errorf("error while reading virtual service [%s] stats: %s", vsID, err)
+	}
+
+	return result, nil
+}
+
+// serviceInfo returns information about a virtual service without its
+// stats. Must be called with the Context locked.
+func (ctx *Context) serviceInfo(vs *service) *ServiceInfo {
 	result := ServiceInfo{Options: vs.options}
 
 	// This is O(n), can be optimized with reverse backend map.
@@ -534,13 +762,14 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 		result.Health /= float64(len(result.Backends))
 	}
 
-	return &result, nil
+	return &result
 }
 
 // BackendInfo contains information about backend options and pulse.
 type BackendInfo struct {
 	Options *BackendOptions `json:"options"`
 	Metrics pulse.Metrics   `json:"metrics"`
+	Stats   *Stats          `json:"stats,omitempty"`
 }
 
 // GetBackend returns information about a backend.
@@ -554,12 +783,37 @@ func (ctx *Context) GetBackend(vsID, rsID string) (*BackendInfo, error) {
 		return nil, ErrObjectNotFound
 	}
 
-	return &BackendInfo{rs.options, rs.metrics}, nil
+	result := BackendInfo{Options: rs.options, Metrics: rs.metrics}
+
+	if stats, err := ctx.serviceStats(rs.service.options); err != nil {
+		log.Errorf("error while reading backend [%s/%s] stats: %s", vsID, rsID, err)
+	} else if s, exists := stats.Dests[destKey(rs.options.host.String(), rs.options.Port)]; exists {
+		result.Stats = &s
+	}
+
+	return &result, nil
 }
 
-// SetStore: if external kvstore exists, set store to context
+// SetStore: if external kvstore exists, set store to context. Services and
+// backends adopted from IPVS are written to the store, so that they aren't
+// removed by the first sync.
 func (ctx *Context) SetStore(store *Store) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
 	ctx.store = store
+
+	for vsID, vs := range ctx.services {
+		if vs.adopted {
+			store.CreateService(vsID, vs.options)
+		}
+	}
+
+	for rsID, rs := range ctx.backends {
+		if rs.adopted {
+			store.CreateBackend(rs.options.VsID, rsID, rs.options)
+		}
+	}
 }
 
 func (ctx *Context) Synchronize(storeServices map[string]*ServiceOptions, storeBackends map[string]*BackendOptions) {
@@ -604,6 +858,11 @@ func (ctx *Context) Synchronize(storeServices map[string]*ServiceOptions, storeB
 	for id, storeBackendOptions := range storeBackends {
 		if backend, ok := ctx.backends[id]; ok {
 			if backend.options.CompareStoreOptions(storeBackendOptions) {
+				if state := storeBackendOptions.State; len(state) != 0 && state != backend.options.State {
+					if err := ctx.setBackendState(storeBackendOptions.VsID, id, state); err != nil {
+						log.Warnf("change backend state error: %s", err.Error())
+					}
+				}
 				continue
 			}
 			ctx.removeBackend(storeBackendOptions.VsID, id)
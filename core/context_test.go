@@ -1,14 +1,21 @@
 package core
 
 import (
+	"encoding/json"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/kobolog/gorb/pulse"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/assert"
 	"github.com/tehnerd/gnl2go"
 	"syscall"
 	"github.com/kobolog/gorb/disco"
+	"github.com/vishvananda/netlink/nl"
 )
 
 type fakeDisco struct {
@@ -53,6 +60,12 @@ func (f *fakeIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16,
 	return args.Error(0)
 }
 
+func (f *fakeIpvs) AddServiceWithPersistence(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	timeout uint32, netmask uint32) error {
+	args := f.Called(vip, port, protocol, sched, flags, timeout, netmask)
+	return args.Error(0)
+}
+
 func (f *fakeIpvs) DelService(vip string, port uint16, protocol uint16) error {
 	args := f.Called(vip, port, protocol)
 	return args.Error(0)
@@ -68,6 +81,46 @@ func (f *fakeIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport ui
 	return args.Error(0)
 
 }
+func (f *fakeIpvs) AddFWMService(fwmark uint32, sched string, vaf uint16) error {
+	args := f.Called(fwmark, sched, vaf)
+	return args.Error(0)
+}
+
+func (f *fakeIpvs) DelFWMService(fwmark uint32, vaf uint16) error {
+	args := f.Called(fwmark, vaf)
+	return args.Error(0)
+}
+
+func (f *fakeIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	args := f.Called(fwmark, rip, vaf, port, weight, fwd)
+	return args.Error(0)
+}
+
+func (f *fakeIpvs) UpdateFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	args := f.Called(fwmark, rip, vaf, port, weight, fwd)
+	return args.Error(0)
+}
+
+func (f *fakeIpvs) DelFWMDest(fwmark uint32, rip string, vaf uint16, port uint16) error {
+	args := f.Called(fwmark, rip, vaf, port)
+	return args.Error(0)
+}
+
+func (f *fakeIpvs) GetServiceStats(vip string, port uint16, protocol uint16) (*ServiceStats, error) {
+	args := f.Called(vip, port, protocol)
+	return args.Get(0).(*ServiceStats), args.Error(1)
+}
+
+func (f *fakeIpvs) GetFWMServiceStats(fwmark uint32, vaf uint16) (*ServiceStats, error) {
+	args := f.Called(fwmark, vaf)
+	return args.Get(0).(*ServiceStats), args.Error(1)
+}
+
+func (f *fakeIpvs) GetServices() ([]IpvsService, error) {
+	args := f.Called()
+	return args.Get(0).([]IpvsService), args.Error(1)
+}
+
 func (f *fakeIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
 	args := f.Called(vip, vport, rip, rport, protocol)
 	return args.Error(0)
@@ -85,6 +138,8 @@ func newContext(ipvs Ipvs, disco disco.Driver) *Context {
 		services: map[string]*service{},
 		backends: make(map[string]*backend),
 		pulseCh:  make(chan pulse.Update),
+		checks:   make(map[pulse.ID]*sharedCheck),
+		stash:    make(map[pulse.ID]int32),
 		stopCh:   make(chan struct{}),
 		disco: disco,
 	}
@@ -126,6 +181,284 @@ func TestServiceIsCreatedWithShFlags(t *testing.T) {
 	mockDisco.AssertExpectations(t)
 }
 
+func TestServiceIsCreatedWithPersistence(t *testing.T) {
+	options := &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", Method: "wrr", Flags: "flag-1",
+		Persistent: true, PersistenceTimeout: "10m", PersistenceNetmask: 24}
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddServiceWithPersistence", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "wrr",
+		gnl2go.U32ToBinFlags(gnl2go.IP_VS_SVC_F_SCHED1|gnl2go.IP_VS_SVC_F_PERSISTENT), uint32(600), uint32(24)).Return(nil)
+	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+
+	err := c.createService(vsID, options)
+	assert.NoError(t, err)
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestFwMarkServiceLifecycle(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddFWMService", uint32(7), "wrr", uint16(syscall.AF_INET)).Return(nil)
+	mockIpvs.On("AddFWMDestFWD", uint32(7), "127.0.0.1", uint16(syscall.AF_INET), uint16(8080), int32(100),
+		uint32(gnl2go.IPVS_MASQUERADING)).Return(nil)
+	mockIpvs.On("UpdateFWMDestFWD", uint32(7), "127.0.0.1", uint16(syscall.AF_INET), uint16(8080), int32(50),
+		uint32(gnl2go.IPVS_MASQUERADING)).Return(nil)
+	mockIpvs.On("DelFWMService", uint32(7), uint16(syscall.AF_INET)).Return(nil)
+
+	assert.NoError(t, c.createService(vsID, &ServiceOptions{FwMark: 7}))
+
+	options := &BackendOptions{Host: "127.0.0.1", Port: 8080, Pulse: &pulse.Options{Type: "none"}}
+	assert.NoError(t, c.createBackend(vsID, rsID, options))
+
+	_, err := c.updateBackend(vsID, rsID, 50)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrIncompatibleAFs, c.createBackend(vsID, "rs6", &BackendOptions{Host: "::1", Port: 8080}))
+
+	_, err = c.removeService(vsID)
+	assert.NoError(t, err)
+
+	// Neither the service nor its backends are exposed to Disco.
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestAdoptImportsIpvsServices(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+	defer close(c.stopCh)
+
+	// IPv4 persistence netmasks are read as masks in network byte order.
+	mask := nl.NativeEndian().Uint32(net.CIDRMask(24, 32))
+
+	mockIpvs.On("GetServices").Return([]IpvsService{{
+		AF:       syscall.AF_INET,
+		Protocol: syscall.IPPROTO_TCP,
+		VIP:      "127.0.0.1",
+		Port:     80,
+		Sched:    "sh",
+		Flags:    gnl2go.IP_VS_SVC_F_PERSISTENT | gnl2go.IP_VS_SVC_F_HASHED | gnl2go.IP_VS_SVC_F_SCHED_SH_PORT,
+		Timeout:  60,
+		Netmask:  mask,
+		Dests: []IpvsDest{
+			{IP: "127.0.0.1", Port: 8080, Weight: 0, Fwd: gnl2go.IPVS_DIRECTROUTE},
+			{IP: "127.0.0.1", Port: 8081, Weight: 1, Fwd: 1},
+		},
+	}, {
+		AF:     syscall.AF_INET6,
+		FwMark: 7,
+		Sched:  "wrr",
+		Dests:  []IpvsDest{{IP: "::1", Port: 8080, Weight: 50}},
+	}}, nil)
+	mockDisco.On("Expose", "tcp-127.0.0.1-80", "127.0.0.1", uint16(80)).Return(nil)
+
+	assert.NoError(t, c.adopt(nil))
+	assert.Len(t, c.services, 2)
+
+	vs := c.services["tcp-127.0.0.1-80"].options
+	assert.Equal(t, "sh-port", vs.Flags)
+	assert.True(t, vs.Persistent)
+	assert.Equal(t, time.Minute, vs.persistenceTimeout)
+	assert.Equal(t, 24, vs.PersistenceNetmask)
+
+	assert.Equal(t, "ipv6", c.services["fwmark-7-ipv6"].options.Family)
+	assert.True(t, c.services["tcp-127.0.0.1-80"].adopted)
+
+	// Backends forwarded to the local node aren't supported, so they're skipped.
+	assert.Len(t, c.backends, 2)
+
+	rs := c.backends["tcp-127.0.0.1-80-127.0.0.1-8080"].options
+	assert.Equal(t, "dr", rs.Method)
+	assert.Equal(t, int32(0), rs.Weight)
+	assert.Equal(t, "tcp-127.0.0.1-80", rs.VsID)
+	assert.Equal(t, "none", rs.Pulse.Type)
+	assert.Equal(t, int32(50), c.backends["fwmark-7-ipv6-::1-8080"].options.Weight)
+
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestAdoptUsesPulseOptions(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	mockIpvs.On("GetServices").Return([]IpvsService{{
+		AF:     syscall.AF_INET,
+		FwMark: 7,
+		Sched:  "wrr",
+		Dests:  []IpvsDest{{IP: "127.0.0.1", Port: 8080, Weight: 50}, {IP: "127.0.0.1", Port: 8081, Weight: 50}},
+	}}, nil)
+
+	assert.NoError(t, c.adopt(&pulse.Options{Type: "tcp", Interval: "1m"}))
+	assert.Len(t, c.backends, 2)
+
+	for _, rs := range c.backends {
+		defer rs.monitor.Stop()
+
+		assert.Equal(t, "tcp", rs.options.Pulse.Type)
+	}
+
+	// Backends have their own checks, since their ports differ.
+	assert.Len(t, c.checks, 2)
+}
+
+func TestCheckDriftRecreatesChangedService(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP, Method: "sh", Flags: "sh-port", Persistent: true,
+		persistenceTimeout: 5 * time.Minute, PersistenceNetmask: 24}}
+	c.backends["rs1"] = &backend{service: c.services[vsID], options: &BackendOptions{Port: 8080,
+		host: net.ParseIP("127.0.0.1"), Weight: 100, methodID: gnl2go.IPVS_MASQUERADING}}
+
+	svc := IpvsService{
+		AF:       syscall.AF_INET,
+		Protocol: syscall.IPPROTO_TCP,
+		VIP:      "127.0.0.1",
+		Port:     80,
+		Sched:    "sh",
+		Flags:    gnl2go.IP_VS_SVC_F_PERSISTENT | gnl2go.IP_VS_SVC_F_HASHED | gnl2go.IP_VS_SVC_F_SCHED_SH_PORT,
+		Timeout:  300,
+		Netmask:  nl.NativeEndian().Uint32(net.CIDRMask(24, 32)),
+		Dests:    []IpvsDest{{IP: "127.0.0.1", Port: 8080, Weight: 100}},
+	}
+
+	mockIpvs.On("GetServices").Return([]IpvsService{svc}, nil)
+
+	drift, err := c.checkDrift(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drift)
+
+	// Scheduler, flags and persistence are compared.
+	for _, change := range []func(*IpvsService){
+		func(s *IpvsService) { s.Sched = "wrr" },
+		func(s *IpvsService) { s.Flags &^= gnl2go.IP_VS_SVC_F_SCHED_SH_PORT },
+		func(s *IpvsService) { s.Timeout = 60 },
+		func(s *IpvsService) { s.Netmask = nl.NativeEndian().Uint32(net.CIDRMask(32, 32)) },
+	} {
+		changed := svc
+		change(&changed)
+
+		mockIpvs.ExpectedCalls = nil
+		mockIpvs.On("GetServices").Return([]IpvsService{changed}, nil)
+
+		drift, err = c.checkDrift(false)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, drift)
+	}
+
+	// Services can't be edited, so they're re-created with their backends.
+	mockIpvs.On("DelService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP)).Return(nil)
+	mockIpvs.On("AddServiceWithPersistence", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "sh",
+		gnl2go.U32ToBinFlags(gnl2go.IP_VS_SVC_F_PERSISTENT|gnl2go.IP_VS_SVC_F_SCHED_SH_PORT),
+		uint32(300), uint32(24)).Return(nil)
+	mockIpvs.On("AddDestPort", "127.0.0.1", uint16(80), "127.0.0.1", uint16(8080),
+		uint16(syscall.IPPROTO_TCP), int32(100), uint32(gnl2go.IPVS_MASQUERADING)).Return(nil)
+
+	drift, err = c.checkDrift(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, drift)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestCheckDriftRepairsIpvs(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP, Method: "wrr"}}
+	c.services["fwmark"] = &service{options: &ServiceOptions{FwMark: 7, af: syscall.AF_INET, Method: "wrr"}}
+	c.backends["rs1"] = &backend{service: c.services[vsID], options: &BackendOptions{Port: 8080,
+		host: net.ParseIP("127.0.0.1"), Weight: 100, methodID: gnl2go.IPVS_MASQUERADING}}
+	c.backends["rs2"] = &backend{service: c.services[vsID], options: &BackendOptions{Port: 8081,
+		host: net.ParseIP("127.0.0.1"), Weight: 50, methodID: gnl2go.IPVS_MASQUERADING}}
+
+	mockIpvs.On("GetServices").Return([]IpvsService{{
+		AF:       syscall.AF_INET,
+		Protocol: syscall.IPPROTO_TCP,
+		VIP:      "127.0.0.1",
+		Port:     80,
+		Sched:    "wrr",
+		Dests: []IpvsDest{
+			{IP: "127.0.0.1", Port: 8080, Weight: 10},
+			{IP: "127.0.0.1", Port: 9090, Weight: 100},
+		},
+	}, {
+		AF:       syscall.AF_INET,
+		Protocol: syscall.IPPROTO_UDP,
+		VIP:      "127.0.0.1",
+		Port:     53,
+		Sched:    "rr",
+	}}, nil)
+
+	// Changes are only reported unless they have to be repaired.
+	drift, err := c.checkDrift(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, drift)
+	mockIpvs.AssertExpectations(t)
+
+	mockIpvs.On("AddFWMService", uint32(7), "wrr", uint16(syscall.AF_INET)).Return(nil)
+	mockIpvs.On("UpdateDestPort", "127.0.0.1", uint16(80), "127.0.0.1", uint16(8080),
+		uint16(syscall.IPPROTO_TCP), int32(100), uint32(gnl2go.IPVS_MASQUERADING)).Return(nil)
+	mockIpvs.On("AddDestPort", "127.0.0.1", uint16(80), "127.0.0.1", uint16(8081),
+		uint16(syscall.IPPROTO_TCP), int32(50), uint32(gnl2go.IPVS_MASQUERADING)).Return(nil)
+	mockIpvs.On("DelDestPort", "127.0.0.1", uint16(80), "127.0.0.1", uint16(9090),
+		uint16(syscall.IPPROTO_TCP)).Return(nil)
+	mockIpvs.On("DelService", "127.0.0.1", uint16(53), uint16(syscall.IPPROTO_UDP)).Return(nil)
+
+	drift, err = c.checkDrift(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, drift)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestDryRunSimulatesIpvs(t *testing.T) {
+	// Neither IPVS nor the interface are touched in a dry run.
+	c, err := NewContext(ContextOptions{DryRun: true, VipInterface: "nonexistent", PulseWorkers: 1})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	assert.NoError(t, c.CreateService(vsID, &ServiceOptions{Port: 80, Host: "127.0.0.1"}))
+	assert.NoError(t, c.CreateBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.1", Port: 8080,
+		Pulse: &pulse.Options{Type: "none"}}))
+
+	table, err := c.IpvsTable()
+	assert.NoError(t, err)
+	assert.Len(t, table, 1)
+	assert.Equal(t, []IpvsDest{{IP: "127.0.0.1", Port: 8080, Weight: 100}}, table[0].Dests)
+}
+
+func TestServiceAndBackendInfoIncludeStats(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP}}
+	c.backends[rsID] = &backend{service: c.services[vsID], options: &BackendOptions{Port: 8080,
+		host: net.ParseIP("127.0.0.1")}}
+
+	mockIpvs.On("GetServiceStats", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP)).Return(&ServiceStats{
+		Stats: Stats{ActiveConns: 2, Conns: 5},
+		Dests: map[string]Stats{"127.0.0.1:8080": {ActiveConns: 2, Conns: 5, BytesIn: 42}},
+	}, nil)
+
+	vs, err := c.GetService(vsID)
+	assert.NoError(t, err)
+	assert.Equal(t, &Stats{ActiveConns: 2, Conns: 5}, vs.Stats)
+
+	rs, err := c.GetBackend(vsID, rsID)
+	assert.NoError(t, err)
+	assert.Equal(t, &Stats{ActiveConns: 2, Conns: 5, BytesIn: 42}, rs.Stats)
+	mockIpvs.AssertExpectations(t)
+}
+
 func TestPulseUpdateSetsBackendWeightToZeroOnStatusDown(t *testing.T) {
 	stash := make(map[pulse.ID]int32)
 	backends := map[string]*backend{rsID: &backend{service: &virtualService, options: &BackendOptions{Weight:100}}}
@@ -170,6 +503,27 @@ func TestPulseUpdateRemovesStashWhenBackendHasFullyRecovered(t *testing.T) {
 	mockIpvs.AssertExpectations(t)
 }
 
+func TestPulseUpdateReducesBackendWeightOnPenalty(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	backends := map[string]*backend{rsID: &backend{service: &virtualService, options: &BackendOptions{Weight: 100}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(25), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 1, Penalty: 0.75}})
+	assert.Equal(t, stash[pulse.ID{VsID: vsID, RsID: rsID}], int32(100))
+	mockIpvs.AssertExpectations(t)
+
+	// Penalty is lifted, the full weight is restored.
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(100), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Empty(t, stash)
+	mockIpvs.AssertExpectations(t)
+}
+
 func TestPulseUpdateRemovesStashWhenBackendIsDeleted(t *testing.T) {
 	stash := map[pulse.ID]int32{pulse.ID{VsID: vsID, RsID: rsID}: int32(0)}
 	backends := make(map[string]*backend)
@@ -194,6 +548,30 @@ func TestPulseUpdateRemovesStashWhenDeletedAfterNotification(t *testing.T) {
 	mockIpvs.AssertExpectations(t)
 }
 
+func TestPulseBatchUpdatesAllBackends(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	backends := map[string]*backend{
+		"rs1": &backend{service: &virtualService, options: &BackendOptions{Weight: 100}},
+		"rs2": &backend{service: &virtualService, options: &BackendOptions{Weight: 100}},
+	}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(0), mock.Anything).Return(nil).Twice()
+
+	c.processPulseBatch(stash, []pulse.Update{
+		{Source: pulse.ID{VsID: vsID, RsID: "rs1"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+		{Source: pulse.ID{VsID: vsID, RsID: "rs2"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+		{Source: pulse.ID{VsID: vsID, RsID: "rs3"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+	})
+
+	assert.Len(t, stash, 2)
+	assert.Equal(t, pulse.StatusDown, backends["rs1"].metrics.Status)
+	assert.Equal(t, pulse.StatusDown, backends["rs2"].metrics.Status)
+	mockIpvs.AssertExpectations(t)
+}
+
 func TestServiceIsCreatedWithGenericCustomFlags(t *testing.T) {
 	options := &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", Method: "sh", Flags: "flag-1|flag-2|flag-3"}
 	mockIpvs := &fakeIpvs{}
@@ -209,3 +587,301 @@ func TestServiceIsCreatedWithGenericCustomFlags(t *testing.T) {
 	mockIpvs.AssertExpectations(t)
 	mockDisco.AssertExpectations(t)
 }
+
+func TestBackendIsCreatedWithSlowStart(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP, slowStart: 10 * time.Second}}
+
+	mockIpvs.On("AddDestPort", "127.0.0.1", uint16(80), "127.0.0.1", uint16(8080), uint16(syscall.IPPROTO_TCP),
+		int32(1), mock.Anything).Return(nil)
+
+	options := &BackendOptions{Host: "127.0.0.1", Port: 8080, Weight: 100, Pulse: &pulse.Options{Type: "none"}}
+	assert.NoError(t, c.createBackend(vsID, rsID, options))
+	defer c.backends[rsID].monitor.Stop()
+
+	assert.Equal(t, int32(1), options.Weight)
+	assert.Equal(t, int32(100), c.backends[rsID].ramp.weight)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestSlowStartRampsUpBackendWeight(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	since := time.Now()
+	backends := map[string]*backend{rsID: &backend{service: &virtualService,
+		options: &BackendOptions{Weight: 1, slowStart: 10 * time.Second},
+		ramp:    &ramp{pulse.ID{VsID: vsID, RsID: rsID}, since, 100}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(25), mock.Anything).Return(nil)
+
+	c.processRamps(stash, since.Add(2500*time.Millisecond))
+	assert.NotNil(t, backends[rsID].ramp)
+	mockIpvs.AssertExpectations(t)
+
+	// Health updates don't interfere with the ramp.
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
+	mockIpvs.AssertExpectations(t)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(100), mock.Anything).Return(nil)
+
+	c.processRamps(stash, since.Add(10*time.Second))
+	assert.Nil(t, backends[rsID].ramp)
+	assert.Empty(t, stash)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestSlowStartIsStashedOnStatusDown(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	backends := map[string]*backend{rsID: &backend{service: &virtualService,
+		options: &BackendOptions{Weight: 40, slowStart: 10 * time.Second},
+		ramp:    &ramp{pulse.ID{VsID: vsID, RsID: rsID}, time.Now(), 100}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(0), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Nil(t, backends[rsID].ramp)
+	assert.Equal(t, int32(100), stash[pulse.ID{VsID: vsID, RsID: rsID}])
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPulseUpdateStartsSlowStartOnRecovery(t *testing.T) {
+	stash := map[pulse.ID]int32{pulse.ID{VsID: vsID, RsID: rsID}: int32(100)}
+	backends := map[string]*backend{rsID: &backend{service: &virtualService,
+		options: &BackendOptions{Weight: 0, slowStart: 10 * time.Second},
+		metrics: pulse.Metrics{Status: pulse.StatusDown}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	// The health-proportional weight is not applied.
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
+	assert.Empty(t, stash)
+	assert.Equal(t, int32(100), backends[rsID].ramp.weight)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestBackendsShareIdenticalChecks(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockDisco.On("Remove", "vs2").Return(nil)
+
+	for _, id := range []string{"vs1", "vs2"} {
+		c.services[id] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+			protocol: syscall.IPPROTO_TCP}}
+	}
+
+	mockIpvs.On("AddDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).Return(nil)
+	mockIpvs.On("DelDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockIpvs.On("DelService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP)).Return(nil)
+
+	pulseOptions := func(kind string) *pulse.Options { return &pulse.Options{Type: kind, Interval: "1m"} }
+
+	assert.NoError(t, c.createBackend("vs1", "rs1", &BackendOptions{Host: "127.0.0.1", Port: 8080, Pulse: pulseOptions("none")}))
+	assert.NoError(t, c.createBackend("vs2", "rs2", &BackendOptions{Host: "127.0.0.1", Port: 8080, Pulse: pulseOptions("none")}))
+	assert.NoError(t, c.createBackend("vs2", "rs3", &BackendOptions{Host: "127.0.0.1", Port: 8080, Pulse: pulseOptions("tcp")}))
+	assert.NoError(t, c.createBackend("vs2", "rs4", &BackendOptions{Host: "127.0.0.1", Port: 8081, Pulse: pulseOptions("none")}))
+
+	assert.Len(t, c.checks, 3)
+	assert.Equal(t, c.backends["rs1"].check, c.backends["rs2"].check)
+	assert.True(t, c.backends["rs1"].monitor == c.backends["rs2"].monitor)
+
+	// Results of the shared check are fanned out to both backends.
+	updates := c.fanOut(pulse.Update{Source: c.backends["rs1"].check, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+
+	assert.ElementsMatch(t, []pulse.Update{
+		{Source: pulse.ID{VsID: "vs1", RsID: "rs1"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+		{Source: pulse.ID{VsID: "vs2", RsID: "rs2"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+	}, updates)
+
+	// Late removals of a previous check with the same ID are dropped.
+	assert.Empty(t, c.fanOut(pulse.Update{Source: c.backends["rs1"].check,
+		Metrics: pulse.Metrics{Status: pulse.StatusRemoved}}))
+
+	// The shared check keeps running until the last backend is removed.
+	_, err := c.removeBackend("vs1", "rs1")
+	assert.NoError(t, err)
+	assert.Len(t, c.checks, 3)
+
+	_, err = c.removeService("vs2")
+	assert.NoError(t, err)
+	assert.Empty(t, c.checks)
+}
+
+func TestBackendAttachedToSharedCheckIsSeeded(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	for _, id := range []string{"rs1", "rs2"} {
+		// Other tests might have observed backends with the same IDs.
+		forgetBackend("vs1", id, &BackendOptions{Host: "127.0.0.1", Port: 8080})
+		defer forgetBackend("vs1", id, &BackendOptions{Host: "127.0.0.1", Port: 8080})
+	}
+
+	c.services["vs1"] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP}}
+
+	mockIpvs.On("AddDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).Return(nil)
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(0), mock.Anything).Return(nil)
+
+	assert.NoError(t, c.createBackend("vs1", "rs1", &BackendOptions{Host: "127.0.0.1", Port: 8080,
+		Pulse: &pulse.Options{Type: "none", Interval: "1m"}}))
+	c.processPulseUpdate(c.stash, pulse.Update{Source: c.backends["rs1"].check,
+		Metrics: pulse.Metrics{Status: pulse.StatusDown, Reason: pulse.ReasonConnection}})
+
+	assert.NoError(t, c.createBackend("vs1", "rs2", &BackendOptions{Host: "127.0.0.1", Port: 8080,
+		Pulse: &pulse.Options{Type: "none", Interval: "1m"}}))
+
+	// The new backend shares the status of the check instead of being up.
+	assert.Equal(t, pulse.StatusDown, c.backends["rs2"].metrics.Status)
+	assert.Equal(t, int32(0), c.backends["rs2"].options.Weight)
+	assert.Equal(t, int32(100), c.stash[pulse.ID{VsID: "vs1", RsID: "rs2"}])
+	mockIpvs.AssertExpectations(t)
+
+	// Seeding doesn't count as a check of the new backend.
+	ch := make(chan prometheus.Metric, 100)
+	serviceBackendChecksTotal.Collect(ch)
+	close(ch)
+
+	for metric := range ch {
+		var m dto.Metric
+		metric.Write(&m)
+
+		labels := map[string]string{}
+
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+
+		assert.False(t, labels["service_name"] == "vs1" && labels["name"] == "rs2", "%v", labels)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceBackendChecksTotal.WithLabelValues(
+		"vs1", "rs1", "127.0.0.1", "8080", "failure", pulse.ReasonConnection)))
+}
+
+func TestDrainedBackendKeepsZeroWeight(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP}}
+
+	mockIpvs.On("AddDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(100), mock.Anything).Return(nil)
+
+	options := &BackendOptions{Host: "127.0.0.1", Port: 8080, Weight: 100, Pulse: &pulse.Options{Type: "none"}}
+	assert.NoError(t, c.createBackend(vsID, rsID, options))
+	defer c.backends[rsID].monitor.Stop()
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(0), mock.Anything).Return(nil).Once()
+
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateDrain))
+	assert.Equal(t, int32(0), options.Weight)
+	mockIpvs.AssertExpectations(t)
+
+	// Neither pulse updates nor weight updates bring the backend back.
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
+	assert.Equal(t, pulse.StatusUp, c.backends[rsID].metrics.Status)
+
+	m := storeMock{}
+	c.store = &Store{kvstore: &m.Mock, storeServicePath: "/services", storeBackendPath: "/backends"}
+
+	_, sub := c.Subscribe(vsID, 0)
+	defer sub.Close()
+
+	// The weight to restore is persisted though.
+	m.On("Exists", "/backends/"+rsID).Return(true, nil)
+	m.On("Put", "/backends/"+rsID, mock.MatchedBy(func(value []byte) bool {
+		var opts BackendOptions
+		return json.Unmarshal(value, &opts) == nil && opts.Weight == 70 && opts.State == StateDrain
+	}), mock.Anything).Return(nil).Once()
+
+	_, err := c.UpdateBackend(vsID, rsID, 70)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), options.Weight)
+	mockIpvs.AssertExpectations(t)
+	m.AssertExpectations(t)
+
+	e := <-sub.C
+	assert.Equal(t, EventBackendWeight, e.Type)
+	assert.Equal(t, StateDrain, e.State)
+	assert.Equal(t, int32(70), *e.Weight)
+
+	c.store = nil
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(70), mock.Anything).Return(nil).Once()
+
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateActive))
+	assert.Equal(t, int32(70), options.Weight)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestDrainedBackendRestoresStashedWeight(t *testing.T) {
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP}}
+
+	mockIpvs.On("AddDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(100), mock.Anything).Return(nil)
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(0), mock.Anything).Return(nil)
+
+	options := &BackendOptions{Host: "127.0.0.1", Port: 8080, Weight: 100, Pulse: &pulse.Options{Type: "none"}}
+	assert.NoError(t, c.createBackend(vsID, rsID, options))
+	defer c.backends[rsID].monitor.Stop()
+
+	c.processPulseUpdate(c.stash, pulse.Update{id, pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Equal(t, int32(100), c.stash[id])
+
+	// The stashed weight is restored instead of the zero one of the failing backend.
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateDrain))
+	assert.Equal(t, int32(100), c.backends[rsID].restore)
+	assert.Empty(t, c.stash)
+
+	// Still failing backends are stashed again once active.
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateActive))
+	assert.Equal(t, int32(0), options.Weight)
+	assert.Equal(t, int32(100), c.stash[id])
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestMaintenanceSuspendsPulse(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, host: net.ParseIP("127.0.0.1"),
+		protocol: syscall.IPPROTO_TCP}}
+
+	mockIpvs.On("AddDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		int32(0), mock.Anything).Return(nil)
+
+	// Backends restored from the store keep their state.
+	options := &BackendOptions{Host: "127.0.0.1", Port: 8080, Weight: 100, State: StateMaintenance,
+		Pulse: &pulse.Options{Type: "none"}}
+	assert.NoError(t, c.createBackend(vsID, rsID, options))
+	assert.Empty(t, c.checks)
+
+	assert.Equal(t, ErrUnknownState, c.SetBackendState(vsID, rsID, "down"))
+
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateDrain))
+	assert.Len(t, c.checks, 1)
+
+	assert.NoError(t, c.SetBackendState(vsID, rsID, StateMaintenance))
+	assert.Empty(t, c.checks)
+	assert.Equal(t, int32(0), options.Weight)
+	mockIpvs.AssertExpectations(t)
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Possible event types.
+const (
+	EventServiceCreated = "service-created"
+	EventServiceRemoved = "service-removed"
+	EventBackendCreated = "backend-created"
+	EventBackendRemoved = "backend-removed"
+	EventBackendStatus  = "backend-status"
+	EventBackendWeight  = "backend-weight"
+	EventBackendState   = "backend-state"
+)
+
+const (
+	// Number of recent events kept for replaying.
+	eventHistory = 1024
+
+	// Subscribers which fall behind this much are disconnected.
+	eventBacklog = 256
+)
+
+// Event describes a change of virtual service or backend state.
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	VsID string    `json:"vsid"`
+	RsID string    `json:"rsid,omitempty"`
+
+	// Backend status, administrative state and weight after the change,
+	// if applicable.
+	Status string `json:"status,omitempty"`
+	State  string `json:"state,omitempty"`
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// Subscription is a stream of events. The channel is closed if the
+// subscriber doesn't keep up with the events.
+type Subscription struct {
+	C <-chan Event
+
+	bus  *eventBus
+	ch   chan Event
+	vsID string
+}
+
+// Close stops the event delivery.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// eventBus keeps recent events and broadcasts new ones to subscribers.
+// The zero value is ready to use.
+type eventBus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[*Subscription]struct{}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	e.ID, e.Time = b.lastID, time.Now()
+
+	b.history = append(b.history, e)
+
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+
+	for s := range b.subscribers {
+		if len(s.vsID) != 0 && s.vsID != e.VsID {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+			// The subscriber can reconnect and replay missed events.
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// subscribe returns recent events after the given one along with the
+// subscription to new events, optionally filtered by the virtual service.
+func (b *eventBus) subscribe(vsID string, since uint64) ([]Event, *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if since > b.lastID {
+		// Event IDs are reset when GORB restarts.
+		since = 0
+	}
+
+	var replay []Event
+
+	for _, e := range b.history {
+		if e.ID > since && (len(vsID) == 0 || vsID == e.VsID) {
+			replay = append(replay, e)
+		}
+	}
+
+	ch := make(chan Event, eventBacklog)
+	s := &Subscription{C: ch, bus: b, ch: ch, vsID: vsID}
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Subscription]struct{})
+	}
+
+	b.subscribers[s] = struct{}{}
+
+	return replay, s
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// Subscribe returns recent events after the given event ID along with the
+// subscription to new events. Events can be filtered by the virtual service,
+// empty vsID matches all of them.
+func (ctx *Context) Subscribe(vsID string, since uint64) ([]Event, *Subscription) {
+	return ctx.events.subscribe(vsID, since)
+}
+
+func backendEvent(kind, vsID, rsID string, weight int32) Event {
+	return Event{Type: kind, VsID: vsID, RsID: rsID, Weight: &weight}
+}
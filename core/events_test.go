@@ -0,0 +1,89 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/kobolog/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEventsAreReplayedAndFiltered(t *testing.T) {
+	var bus eventBus
+
+	bus.publish(Event{Type: EventServiceCreated, VsID: "vs1"})
+	bus.publish(Event{Type: EventServiceCreated, VsID: "vs2"})
+	bus.publish(backendEvent(EventBackendCreated, "vs1", "rs1", 100))
+
+	replay, sub := bus.subscribe("vs1", 0)
+	defer sub.Close()
+
+	assert.Len(t, replay, 2)
+	assert.Equal(t, uint64(1), replay[0].ID)
+	assert.Equal(t, uint64(3), replay[1].ID)
+	assert.Equal(t, int32(100), *replay[1].Weight)
+
+	// Only events after the last seen one are replayed.
+	replay, other := bus.subscribe("", 2)
+	defer other.Close()
+
+	assert.Len(t, replay, 1)
+	assert.Equal(t, uint64(3), replay[0].ID)
+
+	// Last seen event from before a restart.
+	replay, restarted := bus.subscribe("", 42)
+	defer restarted.Close()
+
+	assert.Len(t, replay, 3)
+
+	bus.publish(Event{Type: EventServiceRemoved, VsID: "vs2"})
+	bus.publish(Event{Type: EventServiceRemoved, VsID: "vs1"})
+
+	e := <-sub.C
+	assert.Equal(t, EventServiceRemoved, e.Type)
+	assert.Equal(t, "vs1", e.VsID)
+	assert.Equal(t, uint64(5), e.ID)
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	var bus eventBus
+
+	_, sub := bus.subscribe("", 0)
+
+	for i := 0; i <= eventBacklog; i++ {
+		bus.publish(Event{Type: EventServiceCreated, VsID: "vs"})
+	}
+
+	for range sub.C {
+	}
+
+	// Closing a disconnected subscription is safe.
+	sub.Close()
+
+	assert.Len(t, bus.history, eventBacklog+1)
+}
+
+func TestPulseUpdatePublishesEvents(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	backends := map[string]*backend{rsID: &backend{service: &virtualService, options: &BackendOptions{Weight: 100}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	_, sub := c.Subscribe(vsID, 0)
+	defer sub.Close()
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(0), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+
+	e := <-sub.C
+	assert.Equal(t, EventBackendStatus, e.Type)
+	assert.Equal(t, rsID, e.RsID)
+	assert.Equal(t, "Down", e.Status)
+
+	e = <-sub.C
+	assert.Equal(t, EventBackendWeight, e.Type)
+	assert.Equal(t, int32(0), *e.Weight)
+	mockIpvs.AssertExpectations(t)
+}
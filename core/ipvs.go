@@ -0,0 +1,175 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	"github.com/tehnerd/gnl2go"
+)
+
+// IpvsService is a virtual service found in IPVS, along with its backends.
+type IpvsService struct {
+	AF       uint16     `json:"af"`
+	Protocol uint16     `json:"protocol"`
+	VIP      string     `json:"vip,omitempty"`
+	Port     uint16     `json:"port,omitempty"`
+	FwMark   uint32     `json:"fwmark,omitempty"`
+	Sched    string     `json:"sched"`
+	Flags    uint32     `json:"flags"`
+	Timeout  uint32     `json:"timeout"`
+	Netmask  uint32     `json:"netmask"`
+	Dests    []IpvsDest `json:"dests"`
+}
+
+// IpvsDest is a backend of a virtual service found in IPVS.
+type IpvsDest struct {
+	IP     string `json:"ip"`
+	Port   uint16 `json:"port"`
+	Weight int32  `json:"weight"`
+	Fwd    uint32 `json:"fwd"`
+}
+
+// ipvsClient extends the gnl2go client with the features it doesn't
+// support, which are provided by the generic netlink client.
+type ipvsClient struct {
+	*gnl2go.IpvsClient
+	netlink *netlinkIpvs
+}
+
+func (c *ipvsClient) Init() error {
+	if err := c.IpvsClient.Init(); err != nil {
+		return err
+	}
+
+	return c.netlink.Init()
+}
+
+func (c *ipvsClient) AddServiceWithPersistence(vip string, port uint16, protocol uint16, sched string,
+	flags []byte, timeout uint32, netmask uint32) error {
+	return c.netlink.AddServiceWithPersistence(vip, port, protocol, sched, flags, timeout, netmask)
+}
+
+func (c *ipvsClient) GetServiceStats(vip string, port uint16, protocol uint16) (*ServiceStats, error) {
+	return c.netlink.GetServiceStats(vip, port, protocol)
+}
+
+func (c *ipvsClient) GetFWMServiceStats(fwmark uint32, vaf uint16) (*ServiceStats, error) {
+	return c.netlink.GetFWMServiceStats(fwmark, vaf)
+}
+
+func (c *ipvsClient) GetServices() ([]IpvsService, error) {
+	return c.netlink.GetServices()
+}
+
+// endpoint describes the virtual service for logging.
+func (o *ServiceOptions) endpoint() string {
+	if o.FwMark != 0 {
+		return fmt.Sprintf("fwmark %d (%s)", o.FwMark, o.Family)
+	}
+
+	return fmt.Sprintf("%s:%d", o.host, o.Port)
+}
+
+// family returns the address family of the virtual service.
+func (o *ServiceOptions) family() int {
+	if o.FwMark != 0 {
+		return int(o.af)
+	}
+
+	return util.AddrFamily(o.host)
+}
+
+// ipvsFlags returns the IPVS flags of the virtual service.
+func (o *ServiceOptions) ipvsFlags() uint32 {
+	var flags int
+	for _, flag := range strings.Split(o.Flags, "|") {
+		flags = flags | schedulerFlags[flag]
+	}
+
+	if o.Persistent {
+		flags |= gnl2go.IP_VS_SVC_F_PERSISTENT
+	}
+
+	return uint32(flags)
+}
+
+// addService creates the virtual service in IPVS.
+func (ctx *Context) addService(vs *ServiceOptions) error {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.AddFWMService(vs.FwMark, vs.Method, vs.af)
+	}
+
+	flags := vs.ipvsFlags()
+
+	if vs.Persistent {
+		return ctx.ipvs.AddServiceWithPersistence(vs.host.String(), vs.Port, vs.protocol, vs.Method,
+			gnl2go.U32ToBinFlags(flags), uint32(vs.persistenceTimeout/time.Second),
+			uint32(vs.PersistenceNetmask))
+	} else if flags != 0 {
+		return ctx.ipvs.AddServiceWithFlags(vs.host.String(), vs.Port, vs.protocol, vs.Method,
+			gnl2go.U32ToBinFlags(flags))
+	}
+
+	return ctx.ipvs.AddService(vs.host.String(), vs.Port, vs.protocol, vs.Method)
+}
+
+// delService removes the virtual service from IPVS.
+func (ctx *Context) delService(vs *ServiceOptions) error {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.DelFWMService(vs.FwMark, vs.af)
+	}
+
+	return ctx.ipvs.DelService(vs.host.String(), vs.Port, vs.protocol)
+}
+
+// addDest adds the backend to the virtual service in IPVS.
+func (ctx *Context) addDest(vs *ServiceOptions, rs *BackendOptions, weight int32) error {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.AddFWMDestFWD(vs.FwMark, rs.host.String(), vs.af, rs.Port, weight, rs.methodID)
+	}
+
+	return ctx.ipvs.AddDestPort(vs.host.String(), vs.Port, rs.host.String(), rs.Port, vs.protocol,
+		weight, rs.methodID)
+}
+
+// updateDest changes the backend's weight in IPVS.
+func (ctx *Context) updateDest(vs *ServiceOptions, rs *BackendOptions, weight int32) error {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.UpdateFWMDestFWD(vs.FwMark, rs.host.String(), vs.af, rs.Port, weight, rs.methodID)
+	}
+
+	return ctx.ipvs.UpdateDestPort(vs.host.String(), vs.Port, rs.host.String(), rs.Port, vs.protocol,
+		weight, rs.methodID)
+}
+
+// delDest removes the backend from the virtual service in IPVS.
+func (ctx *Context) delDest(vs *ServiceOptions, rs *BackendOptions) error {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.DelFWMDest(vs.FwMark, rs.host.String(), vs.af, rs.Port)
+	}
+
+	return ctx.ipvs.DelDestPort(vs.host.String(), vs.Port, rs.host.String(), rs.Port, vs.protocol)
+}
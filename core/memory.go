@@ -0,0 +1,283 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// memoryIpvs simulates IPVS in memory for dry runs, returning the same
+// errors as the kernel. Stats are always zero.
+type memoryIpvs struct {
+	mutex    sync.Mutex
+	services []*IpvsService
+}
+
+// Schedulers shipped with the kernel.
+var memorySchedulers = map[string]bool{
+	"rr": true, "wrr": true, "lc": true, "wlc": true, "lblc": true, "lblcr": true, "dh": true,
+	"sh": true, "sed": true, "nq": true, "fo": true, "ovf": true, "mh": true,
+}
+
+func newMemoryIpvs() *memoryIpvs {
+	return &memoryIpvs{}
+}
+
+func (m *memoryIpvs) Init() error {
+	return nil
+}
+
+func (m *memoryIpvs) Exit() {}
+
+func (m *memoryIpvs) Flush() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.services = nil
+
+	return nil
+}
+
+func (m *memoryIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return m.AddServiceWithFlags(vip, port, protocol, sched, ipvsFlags(0))
+}
+
+func (m *memoryIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string,
+	flags []byte) error {
+	af, _, err := ipvsAddr(vip)
+	if err != nil {
+		return err
+	}
+
+	return m.add(IpvsService{AF: af, Protocol: protocol, VIP: net.ParseIP(vip).String(), Port: port},
+		sched, flags, 0, fullNetmask(af))
+}
+
+func (m *memoryIpvs) AddServiceWithPersistence(vip string, port uint16, protocol uint16, sched string,
+	flags []byte, timeout uint32, netmask uint32) error {
+	af, _, err := ipvsAddr(vip)
+	if err != nil {
+		return err
+	}
+
+	if af == syscall.AF_INET {
+		netmask = nl.NativeEndian().Uint32(net.CIDRMask(int(netmask), 32))
+	}
+
+	return m.add(IpvsService{AF: af, Protocol: protocol, VIP: net.ParseIP(vip).String(), Port: port},
+		sched, flags, timeout, netmask)
+}
+
+func (m *memoryIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	return m.del(ipvsKey(0, 0, protocol, net.ParseIP(vip).String(), port))
+}
+
+func (m *memoryIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32) error {
+	return m.setDest(ipvsKey(0, 0, protocol, net.ParseIP(vip).String(), vport), rip, rport, weight, fwd, true)
+}
+
+func (m *memoryIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32) error {
+	return m.setDest(ipvsKey(0, 0, protocol, net.ParseIP(vip).String(), vport), rip, rport, weight, fwd, false)
+}
+
+func (m *memoryIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	return m.delDest(ipvsKey(0, 0, protocol, net.ParseIP(vip).String(), vport), rip, rport)
+}
+
+func (m *memoryIpvs) AddFWMService(fwmark uint32, sched string, vaf uint16) error {
+	return m.add(IpvsService{AF: vaf, FwMark: fwmark}, sched, ipvsFlags(0), 0, fullNetmask(vaf))
+}
+
+func (m *memoryIpvs) DelFWMService(fwmark uint32, vaf uint16) error {
+	return m.del(ipvsKey(fwmark, vaf, 0, "", 0))
+}
+
+func (m *memoryIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32,
+	fwd uint32) error {
+	return m.setDest(ipvsKey(fwmark, vaf, 0, "", 0), rip, port, weight, fwd, true)
+}
+
+func (m *memoryIpvs) UpdateFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32,
+	fwd uint32) error {
+	return m.setDest(ipvsKey(fwmark, vaf, 0, "", 0), rip, port, weight, fwd, false)
+}
+
+func (m *memoryIpvs) DelFWMDest(fwmark uint32, rip string, vaf uint16, port uint16) error {
+	return m.delDest(ipvsKey(fwmark, vaf, 0, "", 0), rip, port)
+}
+
+func (m *memoryIpvs) GetServiceStats(vip string, port uint16, protocol uint16) (*ServiceStats, error) {
+	return m.stats(ipvsKey(0, 0, protocol, net.ParseIP(vip).String(), port))
+}
+
+func (m *memoryIpvs) GetFWMServiceStats(fwmark uint32, vaf uint16) (*ServiceStats, error) {
+	return m.stats(ipvsKey(fwmark, vaf, 0, "", 0))
+}
+
+func (m *memoryIpvs) GetServices() ([]IpvsService, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]IpvsService, 0, len(m.services))
+
+	for _, svc := range m.services {
+		s := *svc
+		s.Dests = append([]IpvsDest(nil), svc.Dests...)
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+func (m *memoryIpvs) add(svc IpvsService, sched string, flags []byte, timeout, netmask uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.find(svc.key()) != nil {
+		return syscall.EEXIST
+	} else if !memorySchedulers[sched] {
+		return syscall.ENOENT
+	}
+
+	if len(flags) == 8 {
+		svc.Flags = nl.NativeEndian().Uint32(flags[:4]) & nl.NativeEndian().Uint32(flags[4:])
+	}
+
+	// Services in the table are always hashed.
+	svc.Flags |= ipvsSvcFlagHashed
+	svc.Sched, svc.Timeout, svc.Netmask = sched, timeout, netmask
+
+	m.services = append(m.services, &svc)
+
+	return nil
+}
+
+func (m *memoryIpvs) del(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, svc := range m.services {
+		if svc.key() == key {
+			m.services = append(m.services[:i], m.services[i+1:]...)
+			return nil
+		}
+	}
+
+	return syscall.ESRCH
+}
+
+func (m *memoryIpvs) setDest(key, rip string, port uint16, weight int32, fwd uint32, create bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	af, _, err := ipvsAddr(rip)
+	if err != nil {
+		return err
+	}
+
+	svc := m.find(key)
+
+	if svc == nil {
+		return syscall.ESRCH
+	} else if af != svc.AF && fwd&ipvsConnFwdMask != ipvsConnFwdTunnel {
+		// Only tunneled backends can have another address family.
+		return syscall.EINVAL
+	} else if weight < 0 {
+		return syscall.ERANGE
+	}
+
+	dest := IpvsDest{IP: net.ParseIP(rip).String(), Port: port, Weight: weight, Fwd: fwd & ipvsConnFwdMask}
+
+	for i := range svc.Dests {
+		if destKey(svc.Dests[i].IP, svc.Dests[i].Port) != destKey(dest.IP, dest.Port) {
+			continue
+		} else if create {
+			return syscall.EEXIST
+		}
+
+		svc.Dests[i] = dest
+
+		return nil
+	}
+
+	if !create {
+		return syscall.ENOENT
+	}
+
+	svc.Dests = append(svc.Dests, dest)
+
+	return nil
+}
+
+func (m *memoryIpvs) delDest(key, rip string, port uint16) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	svc := m.find(key)
+
+	if svc == nil {
+		return syscall.ESRCH
+	}
+
+	for i, dest := range svc.Dests {
+		if destKey(dest.IP, dest.Port) == destKey(net.ParseIP(rip).String(), port) {
+			svc.Dests = append(svc.Dests[:i], svc.Dests[i+1:]...)
+			return nil
+		}
+	}
+
+	return syscall.ENOENT
+}
+
+func (m *memoryIpvs) stats(key string) (*ServiceStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	svc := m.find(key)
+
+	if svc == nil {
+		return nil, syscall.ESRCH
+	}
+
+	result := &ServiceStats{Dests: make(map[string]Stats)}
+
+	for _, dest := range svc.Dests {
+		result.Dests[destKey(dest.IP, dest.Port)] = Stats{}
+	}
+
+	return result, nil
+}
+
+func (m *memoryIpvs) find(key string) *IpvsService {
+	for _, svc := range m.services {
+		if svc.key() == key {
+			return svc
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,595 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// IPVS generic netlink family, commands and attributes, see linux/ip_vs.h.
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 1
+
+	ipvsCmdNewService = 1
+	ipvsCmdDelService = 3
+	ipvsCmdGetService = 4
+	ipvsCmdNewDest    = 5
+	ipvsCmdSetDest    = 6
+	ipvsCmdDelDest    = 7
+	ipvsCmdGetDest    = 8
+	ipvsCmdFlush      = 17
+
+	ipvsCmdAttrService = 1
+	ipvsCmdAttrDest    = 2
+
+	ipvsSvcAttrAF        = 1
+	ipvsSvcAttrProtocol  = 2
+	ipvsSvcAttrAddr      = 3
+	ipvsSvcAttrPort      = 4
+	ipvsSvcAttrFwMark    = 5
+	ipvsSvcAttrSchedName = 6
+	ipvsSvcAttrFlags     = 7
+	ipvsSvcAttrTimeout   = 8
+	ipvsSvcAttrNetmask   = 9
+	ipvsSvcAttrStats     = 10
+	ipvsSvcAttrStats64   = 12
+
+	ipvsDestAttrAddr        = 1
+	ipvsDestAttrPort        = 2
+	ipvsDestAttrFwdMethod   = 3
+	ipvsDestAttrWeight      = 4
+	ipvsDestAttrUThresh     = 5
+	ipvsDestAttrLThresh     = 6
+	ipvsDestAttrActiveConns = 7
+	ipvsDestAttrInactConns  = 8
+	ipvsDestAttrStats       = 10
+	ipvsDestAttrAddrFamily  = 11
+	ipvsDestAttrStats64     = 12
+
+	ipvsStatsAttrConns    = 1
+	ipvsStatsAttrInPkts   = 2
+	ipvsStatsAttrOutPkts  = 3
+	ipvsStatsAttrInBytes  = 4
+	ipvsStatsAttrOutBytes = 5
+	ipvsStatsAttrCPS      = 6
+	ipvsStatsAttrInPPS    = 7
+	ipvsStatsAttrOutPPS   = 8
+	ipvsStatsAttrInBPS    = 9
+	ipvsStatsAttrOutBPS   = 10
+
+	// Virtual service flags. Scheduler flags are specific to the scheduler,
+	// e.g. the second one is sh-port for the sh scheduler.
+	ipvsSvcFlagPersistent = 0x1
+	ipvsSvcFlagHashed     = 0x2
+	ipvsSvcFlagSched1     = 0x8
+	ipvsSvcFlagSched2     = 0x10
+	ipvsSvcFlagSched3     = 0x20
+
+	// Forwarding methods, which are the lower bits of the destination
+	// connection flags.
+	ipvsConnFwdMasq   = 0x0
+	ipvsConnFwdLocal  = 0x1
+	ipvsConnFwdTunnel = 0x2
+	ipvsConnFwdRoute  = 0x3
+	ipvsConnFwdMask   = 0x7
+)
+
+// ipvsFlags encodes virtual service flags as the kernel expects them, which
+// is the flags followed by the mask of flags to set.
+func ipvsFlags(flags uint32) []byte {
+	b := make([]byte, 8)
+
+	nl.NativeEndian().PutUint32(b[:4], flags)
+	nl.NativeEndian().PutUint32(b[4:], ^uint32(0))
+
+	return b
+}
+
+// netlinkIpvs talks to IPVS over generic netlink directly, without gnl2go.
+// Errors returned by the kernel are syscall.Errno values, e.g. EEXIST for
+// duplicate services or backends, ESRCH for missing services, ENOENT for
+// missing backends and ERANGE for negative weights.
+type netlinkIpvs struct {
+	family uint16
+}
+
+func (c *netlinkIpvs) Init() error {
+	family, err := netlink.GenlFamilyGet(ipvsGenlName)
+	if err != nil {
+		return err
+	}
+
+	c.family = family.ID
+
+	return nil
+}
+
+func (c *netlinkIpvs) Exit() {}
+
+func (c *netlinkIpvs) Flush() error {
+	_, err := c.execute(ipvsCmdFlush, syscall.NLM_F_ACK)
+	return err
+}
+
+func (c *netlinkIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return c.AddServiceWithFlags(vip, port, protocol, sched, ipvsFlags(0))
+}
+
+func (c *netlinkIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string,
+	flags []byte) error {
+	svc, af, err := serviceAttr(vip, port, protocol)
+	if err != nil {
+		return err
+	}
+
+	return c.addService(svc, sched, flags, 0, fullNetmask(af))
+}
+
+// AddServiceWithPersistence creates a persistent virtual service: clients
+// within the same netmask prefix are sent to the same backend until the
+// timeout in seconds expires after their last connection.
+func (c *netlinkIpvs) AddServiceWithPersistence(vip string, port uint16, protocol uint16, sched string,
+	flags []byte, timeout uint32, netmask uint32) error {
+	svc, af, err := serviceAttr(vip, port, protocol)
+	if err != nil {
+		return err
+	}
+
+	if af == syscall.AF_INET {
+		// IPv4 netmasks are passed in network byte order, while IPv6 ones
+		// are prefix lengths.
+		netmask = nl.NativeEndian().Uint32(net.CIDRMask(int(netmask), 32))
+	}
+
+	return c.addService(svc, sched, flags, timeout, netmask)
+}
+
+func (c *netlinkIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	svc, _, err := serviceAttr(vip, port, protocol)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(ipvsCmdDelService, syscall.NLM_F_ACK, svc)
+
+	return err
+}
+
+func (c *netlinkIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32) error {
+	return c.setDest(ipvsCmdNewDest, vip, vport, protocol, rip, rport, weight, fwd)
+}
+
+func (c *netlinkIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32) error {
+	return c.setDest(ipvsCmdSetDest, vip, vport, protocol, rip, rport, weight, fwd)
+}
+
+func (c *netlinkIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	svc, _, err := serviceAttr(vip, vport, protocol)
+	if err != nil {
+		return err
+	}
+
+	return c.delDest(svc, rip, rport)
+}
+
+func (c *netlinkIpvs) AddFWMService(fwmark uint32, sched string, vaf uint16) error {
+	return c.addService(fwmarkAttr(fwmark, vaf), sched, ipvsFlags(0), 0, fullNetmask(vaf))
+}
+
+func (c *netlinkIpvs) DelFWMService(fwmark uint32, vaf uint16) error {
+	_, err := c.execute(ipvsCmdDelService, syscall.NLM_F_ACK, fwmarkAttr(fwmark, vaf))
+	return err
+}
+
+func (c *netlinkIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32,
+	fwd uint32) error {
+	return c.setFWMDest(ipvsCmdNewDest, fwmark, vaf, rip, port, weight, fwd)
+}
+
+func (c *netlinkIpvs) UpdateFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32,
+	fwd uint32) error {
+	return c.setFWMDest(ipvsCmdSetDest, fwmark, vaf, rip, port, weight, fwd)
+}
+
+func (c *netlinkIpvs) DelFWMDest(fwmark uint32, rip string, vaf uint16, port uint16) error {
+	return c.delDest(fwmarkAttr(fwmark, vaf), rip, port)
+}
+
+// GetServiceStats reads the stats of the virtual service and its backends.
+func (c *netlinkIpvs) GetServiceStats(vip string, port uint16, protocol uint16) (*ServiceStats, error) {
+	svc, af, err := serviceAttr(vip, port, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.stats(af, svc)
+}
+
+// GetFWMServiceStats reads the stats of the fwmark virtual service and its
+// backends.
+func (c *netlinkIpvs) GetFWMServiceStats(fwmark uint32, vaf uint16) (*ServiceStats, error) {
+	return c.stats(vaf, fwmarkAttr(fwmark, vaf))
+}
+
+// GetServices dumps all virtual services along with their backends.
+func (c *netlinkIpvs) GetServices() ([]IpvsService, error) {
+	msgs, err := c.execute(ipvsCmdGetService, syscall.NLM_F_DUMP)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []IpvsService
+
+	for _, msg := range msgs {
+		raw := parseAttrs(parseAttrs(msg[nl.SizeofGenlmsg:])[ipvsCmdAttrService])
+		svc := parseService(raw)
+
+		// Destinations are dumped by the same attributes which identify
+		// the service.
+		keys := []uint16{ipvsSvcAttrAF, ipvsSvcAttrProtocol, ipvsSvcAttrAddr, ipvsSvcAttrPort}
+
+		if svc.FwMark != 0 {
+			keys = []uint16{ipvsSvcAttrAF, ipvsSvcAttrFwMark}
+		}
+
+		key := nl.NewRtAttr(ipvsCmdAttrService|int(nl.NLA_F_NESTED), nil)
+
+		for _, k := range keys {
+			key.AddRtAttr(int(k), raw[k])
+		}
+
+		dests, err := c.execute(ipvsCmdGetDest, syscall.NLM_F_DUMP, key)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range dests {
+			dest := parseAttrs(parseAttrs(msg[nl.SizeofGenlmsg:])[ipvsCmdAttrDest])
+
+			if ip, port, ok := parseDest(dest, svc.AF); ok {
+				svc.Dests = append(svc.Dests, IpvsDest{
+					IP:     ip,
+					Port:   port,
+					Weight: int32(parseUint(dest[ipvsDestAttrWeight])),
+					Fwd:    uint32(parseUint(dest[ipvsDestAttrFwdMethod])) & ipvsConnFwdMask,
+				})
+			}
+		}
+
+		result = append(result, svc)
+	}
+
+	return result, nil
+}
+
+func (c *netlinkIpvs) addService(svc *nl.RtAttr, sched string, flags []byte, timeout, netmask uint32) error {
+	svc.AddRtAttr(ipvsSvcAttrSchedName, nl.ZeroTerminated(sched))
+	svc.AddRtAttr(ipvsSvcAttrFlags, flags)
+	svc.AddRtAttr(ipvsSvcAttrTimeout, nl.Uint32Attr(timeout))
+	svc.AddRtAttr(ipvsSvcAttrNetmask, nl.Uint32Attr(netmask))
+
+	_, err := c.execute(ipvsCmdNewService, syscall.NLM_F_ACK, svc)
+
+	return err
+}
+
+func (c *netlinkIpvs) setDest(cmd uint8, vip string, vport uint16, protocol uint16, rip string, rport uint16,
+	weight int32, fwd uint32) error {
+	svc, _, err := serviceAttr(vip, vport, protocol)
+	if err != nil {
+		return err
+	}
+
+	dest, err := destAttr(rip, rport)
+	if err != nil {
+		return err
+	}
+
+	destEntry(dest, weight, fwd)
+
+	_, err = c.execute(cmd, syscall.NLM_F_ACK, svc, dest)
+
+	return err
+}
+
+func (c *netlinkIpvs) setFWMDest(cmd uint8, fwmark uint32, vaf uint16, rip string, port uint16, weight int32,
+	fwd uint32) error {
+	dest, err := destAttr(rip, port)
+	if err != nil {
+		return err
+	}
+
+	destEntry(dest, weight, fwd)
+
+	_, err = c.execute(cmd, syscall.NLM_F_ACK, fwmarkAttr(fwmark, vaf), dest)
+
+	return err
+}
+
+func (c *netlinkIpvs) delDest(svc *nl.RtAttr, rip string, port uint16) error {
+	dest, err := destAttr(rip, port)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(ipvsCmdDelDest, syscall.NLM_F_ACK, svc, dest)
+
+	return err
+}
+
+// stats requests the virtual service and dumps its destinations.
+func (c *netlinkIpvs) stats(af uint16, key *nl.RtAttr) (*ServiceStats, error) {
+	msgs, err := c.execute(ipvsCmdGetService, 0, key)
+	if err != nil {
+		return nil, err
+	} else if len(msgs) == 0 {
+		return nil, ErrObjectNotFound
+	}
+
+	svc := parseAttrs(parseAttrs(msgs[0][nl.SizeofGenlmsg:])[ipvsCmdAttrService])
+	result := &ServiceStats{Stats: parseStats(svc[ipvsSvcAttrStats64], svc[ipvsSvcAttrStats]),
+		Dests: make(map[string]Stats)}
+
+	if msgs, err = c.execute(ipvsCmdGetDest, syscall.NLM_F_DUMP, key); err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		dest := parseAttrs(parseAttrs(msg[nl.SizeofGenlmsg:])[ipvsCmdAttrDest])
+
+		ip, port, ok := parseDest(dest, af)
+
+		if !ok {
+			continue
+		}
+
+		stats := parseStats(dest[ipvsDestAttrStats64], dest[ipvsDestAttrStats])
+		stats.ActiveConns = parseUint(dest[ipvsDestAttrActiveConns])
+		stats.InactiveConns = parseUint(dest[ipvsDestAttrInactConns])
+
+		result.Dests[destKey(ip, port)] = stats
+
+		// Connections are only counted per destination.
+		result.ActiveConns += stats.ActiveConns
+		result.InactiveConns += stats.InactiveConns
+	}
+
+	return result, nil
+}
+
+// execute sends the IPVS command with the given attributes.
+func (c *netlinkIpvs) execute(cmd uint8, flags int, attrs ...*nl.RtAttr) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(int(c.family), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: ipvsGenlVersion})
+
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+
+	return req.Execute(syscall.NETLINK_GENERIC, 0)
+}
+
+// ipvsAddr returns the address family of the IP and the IP itself, padded
+// to the size of IPv6 addresses as the kernel expects.
+func ipvsAddr(s string) (uint16, []byte, error) {
+	ip := net.ParseIP(s)
+
+	if ip == nil {
+		return 0, nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := make([]byte, net.IPv6len)
+		copy(addr, ip4)
+
+		return syscall.AF_INET, addr, nil
+	}
+
+	return syscall.AF_INET6, []byte(ip.To16()), nil
+}
+
+// serviceAttr identifies the virtual service by its address, port and
+// protocol.
+func serviceAttr(vip string, port uint16, protocol uint16) (*nl.RtAttr, uint16, error) {
+	af, addr, err := ipvsAddr(vip)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	svc := nl.NewRtAttr(ipvsCmdAttrService|int(nl.NLA_F_NESTED), nil)
+	svc.AddRtAttr(ipvsSvcAttrAF, nl.Uint16Attr(af))
+	svc.AddRtAttr(ipvsSvcAttrProtocol, nl.Uint16Attr(protocol))
+	svc.AddRtAttr(ipvsSvcAttrAddr, addr)
+	svc.AddRtAttr(ipvsSvcAttrPort, portAttr(port))
+
+	return svc, af, nil
+}
+
+// fwmarkAttr identifies the virtual service by its firewall mark.
+func fwmarkAttr(fwmark uint32, af uint16) *nl.RtAttr {
+	svc := nl.NewRtAttr(ipvsCmdAttrService|int(nl.NLA_F_NESTED), nil)
+	svc.AddRtAttr(ipvsSvcAttrAF, nl.Uint16Attr(af))
+	svc.AddRtAttr(ipvsSvcAttrFwMark, nl.Uint32Attr(fwmark))
+
+	return svc
+}
+
+// destAttr identifies the destination by its address and port.
+func destAttr(rip string, port uint16) (*nl.RtAttr, error) {
+	af, addr, err := ipvsAddr(rip)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := nl.NewRtAttr(ipvsCmdAttrDest|int(nl.NLA_F_NESTED), nil)
+	dest.AddRtAttr(ipvsDestAttrAddr, addr)
+	dest.AddRtAttr(ipvsDestAttrPort, portAttr(port))
+	dest.AddRtAttr(ipvsDestAttrAddrFamily, nl.Uint16Attr(af))
+
+	return dest, nil
+}
+
+// destEntry adds the attributes required to create or update destinations.
+func destEntry(dest *nl.RtAttr, weight int32, fwd uint32) {
+	dest.AddRtAttr(ipvsDestAttrFwdMethod, nl.Uint32Attr(fwd))
+	dest.AddRtAttr(ipvsDestAttrWeight, nl.Uint32Attr(uint32(weight)))
+	dest.AddRtAttr(ipvsDestAttrUThresh, nl.Uint32Attr(0))
+	dest.AddRtAttr(ipvsDestAttrLThresh, nl.Uint32Attr(0))
+}
+
+// portAttr encodes the port in network byte order.
+func portAttr(port uint16) []byte {
+	return []byte{byte(port >> 8), byte(port)}
+}
+
+// fullNetmask is the persistence netmask of non-persistent services.
+func fullNetmask(af uint16) uint32 {
+	if af == syscall.AF_INET6 {
+		return 8 * net.IPv6len
+	}
+
+	return 0xffffffff
+}
+
+// parseAttrs returns netlink attributes by their types.
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(nl.NativeEndian().Uint16(b[0:2]))
+
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+
+		attrs[nl.NativeEndian().Uint16(b[2:4])&nl.NLA_TYPE_MASK] = b[syscall.SizeofRtAttr:length]
+
+		// Attributes are aligned to 4 bytes.
+		if length = (length + 3) &^ 3; length > len(b) {
+			break
+		}
+
+		b = b[length:]
+	}
+
+	return attrs
+}
+
+// parseUint decodes 16, 32 or 64 bit attributes.
+func parseUint(b []byte) uint64 {
+	switch len(b) {
+	case 2:
+		return uint64(nl.NativeEndian().Uint16(b))
+	case 4:
+		return uint64(nl.NativeEndian().Uint32(b))
+	case 8:
+		return nl.NativeEndian().Uint64(b)
+	default:
+		return 0
+	}
+}
+
+// parseStats decodes the 64 bit stats, if supported by the kernel, or
+// falls back to the 32 bit ones.
+func parseStats(stats64, stats []byte) Stats {
+	if len(stats64) != 0 {
+		stats = stats64
+	}
+
+	attrs := parseAttrs(stats)
+
+	return Stats{
+		Conns:      parseUint(attrs[ipvsStatsAttrConns]),
+		PacketsIn:  parseUint(attrs[ipvsStatsAttrInPkts]),
+		PacketsOut: parseUint(attrs[ipvsStatsAttrOutPkts]),
+		BytesIn:    parseUint(attrs[ipvsStatsAttrInBytes]),
+		BytesOut:   parseUint(attrs[ipvsStatsAttrOutBytes]),
+		CPS:        parseUint(attrs[ipvsStatsAttrCPS]),
+		PPSIn:      parseUint(attrs[ipvsStatsAttrInPPS]),
+		PPSOut:     parseUint(attrs[ipvsStatsAttrOutPPS]),
+		BPSIn:      parseUint(attrs[ipvsStatsAttrInBPS]),
+		BPSOut:     parseUint(attrs[ipvsStatsAttrOutBPS]),
+	}
+}
+
+// parseService decodes the virtual service attributes.
+func parseService(attrs map[uint16][]byte) IpvsService {
+	svc := IpvsService{
+		AF:       uint16(parseUint(attrs[ipvsSvcAttrAF])),
+		Protocol: uint16(parseUint(attrs[ipvsSvcAttrProtocol])),
+		FwMark:   uint32(parseUint(attrs[ipvsSvcAttrFwMark])),
+		Sched:    strings.TrimRight(string(attrs[ipvsSvcAttrSchedName]), "\x00"),
+		Timeout:  uint32(parseUint(attrs[ipvsSvcAttrTimeout])),
+		Netmask:  uint32(parseUint(attrs[ipvsSvcAttrNetmask])),
+	}
+
+	if flags := attrs[ipvsSvcAttrFlags]; len(flags) >= 4 {
+		// Flags are followed by the mask of flags to change.
+		svc.Flags = nl.NativeEndian().Uint32(flags[:4])
+	}
+
+	if svc.FwMark != 0 {
+		return svc
+	}
+
+	if ip := net.IP(attrs[ipvsSvcAttrAddr]); svc.AF == syscall.AF_INET && len(ip) >= net.IPv4len {
+		svc.VIP = ip[:net.IPv4len].String()
+	} else {
+		svc.VIP = ip.String()
+	}
+
+	if port := attrs[ipvsSvcAttrPort]; len(port) == 2 {
+		svc.Port = uint16(port[0])<<8 | uint16(port[1])
+	}
+
+	return svc
+}
+
+// parseDest decodes the destination address and port.
+func parseDest(attrs map[uint16][]byte, af uint16) (string, uint16, bool) {
+	ip, daf := net.IP(attrs[ipvsDestAttrAddr]), uint64(af)
+
+	if v, exists := attrs[ipvsDestAttrAddrFamily]; exists {
+		// Destinations of fwmark services can have another family.
+		daf = parseUint(v)
+	}
+
+	if daf == syscall.AF_INET && len(ip) >= net.IPv4len {
+		ip = ip[:net.IPv4len]
+	}
+
+	port := attrs[ipvsDestAttrPort]
+
+	if len(port) != 2 {
+		return "", 0, false
+	}
+
+	return ip.String(), uint16(port[0])<<8 | uint16(port[1]), true
+}
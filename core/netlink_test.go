@@ -0,0 +1,86 @@
+package core
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tehnerd/gnl2go"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+func TestParseStats(t *testing.T) {
+	stats := nl.NewRtAttr(ipvsSvcAttrStats|int(nl.NLA_F_NESTED), nil)
+	stats.AddRtAttr(ipvsStatsAttrConns, nl.Uint32Attr(10))
+	stats.AddRtAttr(ipvsStatsAttrInPkts, nl.Uint32Attr(100))
+	stats.AddRtAttr(ipvsStatsAttrInBytes, nl.Uint64Attr(1<<40))
+	stats.AddRtAttr(ipvsStatsAttrCPS, nl.Uint32Attr(2))
+
+	svc := nl.NewRtAttr(ipvsCmdAttrService|int(nl.NLA_F_NESTED), nil)
+	svc.AddRtAttr(ipvsSvcAttrPort, []byte{0, 80})
+	svc.AddChild(stats)
+
+	attrs := parseAttrs(parseAttrs(svc.Serialize())[ipvsCmdAttrService])
+
+	assert.Equal(t, []byte{0, 80}, attrs[ipvsSvcAttrPort])
+	assert.Equal(t, Stats{Conns: 10, PacketsIn: 100, BytesIn: 1 << 40, CPS: 2},
+		parseStats(attrs[ipvsSvcAttrStats64], attrs[ipvsSvcAttrStats]))
+}
+
+// inNetns runs the test in a new network namespace, since IPVS tables are
+// per namespace, to leave the host ones alone.
+func inNetns(t *testing.T, test func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("IPVS requires root privileges")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("unable to get the network namespace: %s", err)
+	}
+
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("unable to create a network namespace: %s", err)
+	}
+
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	test()
+}
+
+func TestNetlinkIpvsConformance(t *testing.T) {
+	inNetns(t, func() {
+		ipvs := &netlinkIpvs{}
+
+		if err := ipvs.Init(); err != nil {
+			t.Skipf("IPVS is not available: %s", err)
+		}
+
+		testIpvsConformance(t, ipvs)
+	})
+}
+
+// TestIpvsClientConformance runs the same cases against the default client,
+// so that both clients are known to behave the same.
+func TestIpvsClientConformance(t *testing.T) {
+	inNetns(t, func() {
+		ipvs := &ipvsClient{&gnl2go.IpvsClient{}, &netlinkIpvs{}}
+
+		if err := ipvs.Init(); err != nil {
+			t.Skipf("IPVS is not available: %s", err)
+		}
+
+		defer ipvs.Exit()
+
+		testIpvsConformance(t, ipvs)
+	})
+}
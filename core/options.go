@@ -23,29 +23,89 @@ package core
 import (
 	"errors"
 	"net"
+	"net/url"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/kobolog/gorb/pulse"
+	"github.com/kobolog/gorb/util"
 
 	"github.com/tehnerd/gnl2go"
 )
 
 // Possible validation errors.
 var (
-	ErrMissingEndpoint = errors.New("endpoint information is missing")
-	ErrUnknownMethod   = errors.New("specified forwarding method is unknown")
-	ErrUnknownProtocol = errors.New("specified protocol is unknown")
-	ErrUnknownFlag     = errors.New("specified flag is unknown")
+	ErrMissingEndpoint  = errors.New("endpoint information is missing")
+	ErrUnknownMethod    = errors.New("specified forwarding method is unknown")
+	ErrUnknownProtocol  = errors.New("specified protocol is unknown")
+	ErrUnknownFlag      = errors.New("specified flag is unknown")
+	ErrInvalidSlowStart = errors.New("slow start duration must not be negative")
+	ErrInvalidWebhook   = errors.New("webhook URL must be an absolute HTTP(S) URL")
+	ErrUnknownState     = errors.New("specified backend state is unknown")
+
+	ErrInvalidPersistenceTimeout = errors.New("persistence timeout must be positive")
+	ErrInvalidPersistenceNetmask = errors.New("persistence netmask must be a valid prefix length")
+
+	ErrInvalidFwMark = errors.New("fwmark services can't have host, port, protocol, flags or persistence")
+	ErrUnknownFamily = errors.New("specified address family is unknown")
+)
+
+// Possible backend administrative states.
+const (
+	StateActive      = "active"
+	StateDrain       = "drain"
+	StateMaintenance = "maintenance"
 )
 
 // ContextOptions configure Context behavior.
 type ContextOptions struct {
+	// IPVS client, either gnl2go (default) or netlink, which talks to the
+	// kernel over generic netlink directly.
+	IpvsDriver string
+
+	// Simulate IPVS in memory and leave network interfaces alone, so that
+	// neither root privileges nor the ip_vs module are required.
+	DryRun bool
+
 	Disco        string
 	Endpoints    []net.IP
 	Flush        bool
 	ListenPort   uint16
 	VipInterface string
+	Webhooks     []WebhookOptions
+
+	// Size of the pulse worker pool and the maximum number of checks per
+	// second. Without workers, every backend has its own pulse goroutine.
+	PulseWorkers int
+	PulseRate    float64
+
+	// Import virtual services and backends found in IPVS on startup. Adopted
+	// backends are checked with AdoptPulse, the none pulse if it's nil.
+	Adopt      bool
+	AdoptPulse *pulse.Options
+
+	// Interval of checks for IPVS changes made behind GORB's back, e.g.
+	// with ipvsadm, which are reverted if DriftRepair is set.
+	DriftInterval time.Duration
+	DriftRepair   bool
+}
+
+// WebhookOptions describe a webhook notified on backend status transitions.
+// Payloads are signed with the secret, if any.
+type WebhookOptions struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// Validate validates webhook configuration.
+func (o *WebhookOptions) Validate() error {
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return ErrInvalidWebhook
+	}
+
+	return nil
 }
 
 // ServiceOptions describe a virtual service.
@@ -57,16 +117,99 @@ type ServiceOptions struct {
 	Flags      string `json:"flags"`
 	Persistent bool   `json:"persistent"`
 
+	// Firewall mark and address family (ipv4 or ipv6) of packets balanced
+	// by fwmark services, instead of the host, port and protocol.
+	FwMark uint32 `json:"fwmark,omitempty"`
+	Family string `json:"family,omitempty"`
+
+	// Persistence timeout and netmask prefix length of persistent services,
+	// default to 300s and the full address length, respectively.
+	PersistenceTimeout string `json:"persistence_timeout,omitempty"`
+	PersistenceNetmask int    `json:"persistence_netmask,omitempty"`
+
+	// Default slow start duration for the service backends.
+	SlowStart string `json:"slow_start,omitempty"`
+
+	// Webhooks notified on the service backends status transitions.
+	Webhooks []WebhookOptions `json:"webhooks,omitempty"`
+
 	// Host string resolved to an IP, including DNS lookup.
 	host      net.IP
 	delIfAddr bool
 
 	// Protocol string converted to a protocol number.
 	protocol uint16
+
+	// SlowStart string converted to a duration.
+	slowStart time.Duration
+
+	// PersistenceTimeout string converted to a duration.
+	persistenceTimeout time.Duration
+
+	// Family string converted to an address family number.
+	af uint16
 }
 
 // Validate fills missing fields and validates virtual service configuration.
 func (o *ServiceOptions) Validate(defaultHost net.IP) error {
+	if o.FwMark != 0 {
+		if err := o.validateFwMark(); err != nil {
+			return err
+		}
+	} else if err := o.validateEndpoint(defaultHost); err != nil {
+		return err
+	}
+
+	if len(o.Method) == 0 {
+		// WRR since Pulse will dynamically reweight backends.
+		o.Method = "wrr"
+	}
+
+	var err error
+
+	if o.slowStart, err = parseSlowStart(o.SlowStart); err != nil {
+		return err
+	}
+
+	if o.Persistent {
+		if err := o.validatePersistence(); err != nil {
+			return err
+		}
+	}
+
+	for i := range o.Webhooks {
+		if err := o.Webhooks[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *ServiceOptions) validateFwMark() error {
+	if len(o.Host) != 0 || o.Port != 0 || len(o.Protocol) != 0 || len(o.Flags) != 0 || o.Persistent {
+		return ErrInvalidFwMark
+	}
+
+	if len(o.Family) == 0 {
+		o.Family = "ipv4"
+	}
+
+	o.Family = strings.ToLower(o.Family)
+
+	switch o.Family {
+	case "ipv4":
+		o.af = syscall.AF_INET
+	case "ipv6":
+		o.af = syscall.AF_INET6
+	default:
+		return ErrUnknownFamily
+	}
+
+	return nil
+}
+
+func (o *ServiceOptions) validateEndpoint(defaultHost net.IP) error {
 	if o.Port == 0 {
 		return ErrMissingEndpoint
 	}
@@ -106,14 +249,55 @@ func (o *ServiceOptions) Validate(defaultHost net.IP) error {
 		}
 	}
 
-	if len(o.Method) == 0 {
-		// WRR since Pulse will dynamically reweight backends.
-		o.Method = "wrr"
+	return nil
+}
+
+func (o *ServiceOptions) validatePersistence() error {
+	if len(o.PersistenceTimeout) == 0 {
+		o.PersistenceTimeout = "300s"
+	}
+
+	d, err := util.ParseInterval(o.PersistenceTimeout)
+	if err != nil {
+		return err
+	} else if d < time.Second {
+		return ErrInvalidPersistenceTimeout
+	}
+
+	o.persistenceTimeout = d
+
+	bits := 8 * net.IPv6len
+
+	if o.host.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+
+	if o.PersistenceNetmask == 0 {
+		o.PersistenceNetmask = bits
+	}
+
+	if o.PersistenceNetmask < 0 || o.PersistenceNetmask > bits {
+		return ErrInvalidPersistenceNetmask
 	}
 
 	return nil
 }
 
+func parseSlowStart(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	d, err := util.ParseInterval(s)
+	if err != nil {
+		return 0, err
+	} else if d < 0 {
+		return 0, ErrInvalidSlowStart
+	}
+
+	return d, nil
+}
+
 func (o *ServiceOptions) CompareStoreOptions(options *ServiceOptions) bool {
 	if o.Host != options.Host {
 		return false
@@ -133,6 +317,18 @@ func (o *ServiceOptions) CompareStoreOptions(options *ServiceOptions) bool {
 	if o.Persistent != options.Persistent {
 		return false
 	}
+	if o.FwMark != options.FwMark {
+		return false
+	}
+	if o.Family != options.Family {
+		return false
+	}
+	if o.PersistenceTimeout != options.PersistenceTimeout {
+		return false
+	}
+	if o.PersistenceNetmask != options.PersistenceNetmask {
+		return false
+	}
 	return true
 }
 
@@ -145,11 +341,22 @@ type BackendOptions struct {
 	Pulse  *pulse.Options `json:"pulse"`
 	VsID   string         `json:"vsid,omitempty"`
 
+	// Duration of the weight ramp-up after the backend is added or
+	// recovered, overrides the virtual service one.
+	SlowStart string `json:"slow_start,omitempty"`
+
+	// Administrative state: drained backends are taken out of rotation and
+	// backends under maintenance also have their pulse suspended.
+	State string `json:"state,omitempty"`
+
 	// Host string resolved to an IP, including DNS lookup.
 	host net.IP
 
 	// Forwarding method string converted to a forwarding method number.
 	methodID uint32
+
+	// SlowStart string converted to a duration.
+	slowStart time.Duration
 }
 
 // Validate fills missing fields and validates backend configuration.
@@ -190,9 +397,30 @@ func (o *BackendOptions) Validate() error {
 		o.Pulse = &pulse.Options{}
 	}
 
+	var err error
+
+	if o.slowStart, err = parseSlowStart(o.SlowStart); err != nil {
+		return err
+	}
+
+	if o.State, err = parseState(o.State); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func parseState(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case "":
+		return StateActive, nil
+	case StateActive, StateDrain, StateMaintenance:
+		return s, nil
+	default:
+		return "", ErrUnknownState
+	}
+}
+
 func (o *BackendOptions) CompareStoreOptions(options *BackendOptions) bool {
 	if o.Host != options.Host {
 		return false
@@ -2,7 +2,9 @@ package core
 
 
 import (
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,3 +29,66 @@ func TestValidateAcceptsNoFlags(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestValidateParsesSlowStart(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "localhost", SlowStart: "30s"}
+	assert.NoError(t, options.Validate(nil))
+	assert.Equal(t, 30*time.Second, options.slowStart)
+
+	backend := BackendOptions{Port: 80, Host: "localhost", SlowStart: "-5s"}
+	assert.Equal(t, ErrInvalidSlowStart, backend.Validate())
+}
+
+func TestValidateParsesState(t *testing.T) {
+	backend := BackendOptions{Port: 80, Host: "localhost"}
+	assert.NoError(t, backend.Validate())
+	assert.Equal(t, StateActive, backend.State)
+
+	backend = BackendOptions{Port: 80, Host: "localhost", State: "Drain"}
+	assert.NoError(t, backend.Validate())
+	assert.Equal(t, StateDrain, backend.State)
+
+	backend = BackendOptions{Port: 80, Host: "localhost", State: "down"}
+	assert.Equal(t, ErrUnknownState, backend.Validate())
+}
+
+func TestValidateParsesPersistence(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "127.0.0.1", Persistent: true}
+	assert.NoError(t, options.Validate(nil))
+	assert.Equal(t, "300s", options.PersistenceTimeout)
+	assert.Equal(t, 5*time.Minute, options.persistenceTimeout)
+	assert.Equal(t, 32, options.PersistenceNetmask)
+
+	options = ServiceOptions{Port: 80, Host: "::1", Persistent: true, PersistenceNetmask: 64}
+	assert.NoError(t, options.Validate(nil))
+	assert.Equal(t, 64, options.PersistenceNetmask)
+
+	options = ServiceOptions{Port: 80, Host: "127.0.0.1", Persistent: true, PersistenceNetmask: 64}
+	assert.Equal(t, ErrInvalidPersistenceNetmask, options.Validate(nil))
+
+	options = ServiceOptions{Port: 80, Host: "127.0.0.1", Persistent: true, PersistenceTimeout: "-1m"}
+	assert.Equal(t, ErrInvalidPersistenceTimeout, options.Validate(nil))
+
+	// Non-persistent services don't get persistence defaults.
+	options = ServiceOptions{Port: 80, Host: "127.0.0.1"}
+	assert.NoError(t, options.Validate(nil))
+	assert.Empty(t, options.PersistenceTimeout)
+}
+
+func TestValidateParsesFwMark(t *testing.T) {
+	options := ServiceOptions{FwMark: 1}
+	assert.NoError(t, options.Validate(nil))
+	assert.Equal(t, "ipv4", options.Family)
+	assert.Equal(t, syscall.AF_INET, options.family())
+	assert.Equal(t, "wrr", options.Method)
+
+	options = ServiceOptions{FwMark: 1, Family: "IPv6"}
+	assert.NoError(t, options.Validate(nil))
+	assert.Equal(t, syscall.AF_INET6, options.family())
+
+	options = ServiceOptions{FwMark: 1, Family: "ipx"}
+	assert.Equal(t, ErrUnknownFamily, options.Validate(nil))
+
+	options = ServiceOptions{FwMark: 1, Port: 80}
+	assert.Equal(t, ErrInvalidFwMark, options.Validate(nil))
+}
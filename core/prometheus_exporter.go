@@ -3,8 +3,9 @@ package core
 import (
 	"fmt"
 
+	"github.com/kobolog/gorb/pulse"
+
 	log "github.com/Sirupsen/logrus"
-	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -48,6 +49,70 @@ var (
 		Name:      "service_backend_weight",
 		Help:      "Weight of a backend service",
 	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "service_backend_check_duration_seconds",
+		Help:      "Duration of backend service health checks",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_backend_checks_total",
+		Help:      "Number of backend service health checks by result and failure reason",
+	}, []string{"service_name", "name", "host", "port", "result", "reason"})
+
+	serviceBackendTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_backend_transitions_total",
+		Help:      "Number of backend service status transitions",
+	}, []string{"service_name", "name", "host", "port", "from", "to"})
+)
+
+// IPVS stats are exported as is, since they are maintained by the kernel.
+// Services balancing packets by firewall mark have it in the fwmark label
+// instead of the host, port and protocol ones.
+var (
+	serviceConnectionsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_connections_total"),
+		"Number of connections to the load balancer service",
+		[]string{"name", "host", "port", "protocol", "fwmark"}, nil)
+
+	servicePacketsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_packets_total"),
+		"Number of packets of the load balancer service by direction",
+		[]string{"name", "host", "port", "protocol", "fwmark", "direction"}, nil)
+
+	serviceBytesTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_bytes_total"),
+		"Number of bytes of the load balancer service by direction",
+		[]string{"name", "host", "port", "protocol", "fwmark", "direction"}, nil)
+
+	serviceBackendActiveConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_backend_active_connections"),
+		"Number of active connections to a backend service",
+		[]string{"service_name", "name", "host", "port"}, nil)
+
+	serviceBackendInactiveConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_backend_inactive_connections"),
+		"Number of inactive connections to a backend service",
+		[]string{"service_name", "name", "host", "port"}, nil)
+
+	serviceBackendConnectionsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_backend_connections_total"),
+		"Number of connections to a backend service",
+		[]string{"service_name", "name", "host", "port"}, nil)
+
+	serviceBackendPacketsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_backend_packets_total"),
+		"Number of packets of a backend service by direction",
+		[]string{"service_name", "name", "host", "port", "direction"}, nil)
+
+	serviceBackendBytesTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_backend_bytes_total"),
+		"Number of bytes of a backend service by direction",
+		[]string{"service_name", "name", "host", "port", "direction"}, nil)
 )
 
 type Exporter struct {
@@ -67,30 +132,41 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	serviceBackendHealth.Describe(ch)
 	serviceBackendStatus.Describe(ch)
 	serviceBackendWeight.Describe(ch)
+	serviceBackendCheckDuration.Describe(ch)
+	serviceBackendChecksTotal.Describe(ch)
+	serviceBackendTransitionsTotal.Describe(ch)
+	ch <- serviceConnectionsTotal
+	ch <- servicePacketsTotal
+	ch <- serviceBytesTotal
+	ch <- serviceBackendActiveConnections
+	ch <- serviceBackendInactiveConnections
+	ch <- serviceBackendConnectionsTotal
+	ch <- serviceBackendPacketsTotal
+	ch <- serviceBackendBytesTotal
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	if err := e.collect(); err != nil {
-		log.Errorf("error collecting metrics: %s", err)
-		return
-	}
+	e.collect()
 	serviceHealth.Collect(ch)
 	serviceBackends.Collect(ch)
 	serviceBackendUptimeTotal.Collect(ch)
 	serviceBackendHealth.Collect(ch)
 	serviceBackendStatus.Collect(ch)
 	serviceBackendWeight.Collect(ch)
+	serviceBackendCheckDuration.Collect(ch)
+	serviceBackendChecksTotal.Collect(ch)
+	serviceBackendTransitionsTotal.Collect(ch)
+	e.collectStats(ch)
 }
 
-func (e *Exporter) collect() error {
+// collect updates the gauges from the Context. IPVS stats are read only once
+// per service by collectStats.
+func (e *Exporter) collect() {
 	e.ctx.mutex.RLock()
 	defer e.ctx.mutex.RUnlock()
 
-	for serviceName, _ := range e.ctx.services {
-		service, err := e.ctx.GetService(serviceName)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("error getting service: %s", serviceName))
-		}
+	for serviceName, vs := range e.ctx.services {
+		service := e.ctx.serviceInfo(vs)
 
 		serviceHealth.WithLabelValues(serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
 			service.Options.Protocol).
@@ -102,30 +178,147 @@ func (e *Exporter) collect() error {
 
 		for i := 0; i < len(service.Backends); i++ {
 			backendName := service.Backends[i]
-			backend, err := e.ctx.GetBackend(serviceName, backendName)
-			if err != nil {
-				return errors.Wrap(err, fmt.Sprintf("error getting backend %s from service %s", backendName, serviceName))
+			backend := e.ctx.backends[backendName]
+
+			serviceBackendUptimeTotal.WithLabelValues(serviceName, backendName, backend.options.Host,
+				fmt.Sprintf("%d", backend.options.Port)).
+				Set(backend.metrics.Uptime.Seconds())
+
+			serviceBackendHealth.WithLabelValues(serviceName, backendName, backend.options.Host,
+				fmt.Sprintf("%d", backend.options.Port)).
+				Set(backend.metrics.Health)
+
+			serviceBackendStatus.WithLabelValues(serviceName, backendName, backend.options.Host,
+				fmt.Sprintf("%d", backend.options.Port)).
+				Set(float64(backend.metrics.Status))
+
+			serviceBackendWeight.WithLabelValues(serviceName, backendName, backend.options.Host,
+				fmt.Sprintf("%d", backend.options.Port)).
+				Set(float64(backend.options.Weight))
+		}
+	}
+}
+
+func (e *Exporter) collectStats(ch chan<- prometheus.Metric) {
+	e.ctx.mutex.RLock()
+	defer e.ctx.mutex.RUnlock()
+
+	for serviceName, service := range e.ctx.services {
+		stats, err := e.ctx.serviceStats(service.options)
+		if err != nil {
+			log.Errorf("error getting stats of service %s: %s", serviceName, err)
+			continue
+		}
+
+		labels := []string{serviceName, "", "", "", fmt.Sprintf("%d", service.options.FwMark)}
+
+		if service.options.FwMark == 0 {
+			labels = []string{serviceName, service.options.Host, fmt.Sprintf("%d", service.options.Port),
+				service.options.Protocol, ""}
+		}
+
+		ch <- prometheus.MustNewConstMetric(serviceConnectionsTotal, prometheus.CounterValue,
+			float64(stats.Conns), labels...)
+		ch <- prometheus.MustNewConstMetric(servicePacketsTotal, prometheus.CounterValue,
+			float64(stats.PacketsIn), append(labels, "in")...)
+		ch <- prometheus.MustNewConstMetric(servicePacketsTotal, prometheus.CounterValue,
+			float64(stats.PacketsOut), append(labels, "out")...)
+		ch <- prometheus.MustNewConstMetric(serviceBytesTotal, prometheus.CounterValue,
+			float64(stats.BytesIn), append(labels, "in")...)
+		ch <- prometheus.MustNewConstMetric(serviceBytesTotal, prometheus.CounterValue,
+			float64(stats.BytesOut), append(labels, "out")...)
+
+		for backendName, backend := range e.ctx.backends {
+			if backend.service != service {
+				continue
 			}
 
-			serviceBackendUptimeTotal.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Uptime.Seconds())
+			s, exists := stats.Dests[destKey(backend.options.host.String(), backend.options.Port)]
+
+			if !exists {
+				continue
+			}
+
+			labels := []string{serviceName, backendName, backend.options.Host,
+				fmt.Sprintf("%d", backend.options.Port)}
+
+			ch <- prometheus.MustNewConstMetric(serviceBackendActiveConnections, prometheus.GaugeValue,
+				float64(s.ActiveConns), labels...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendInactiveConnections, prometheus.GaugeValue,
+				float64(s.InactiveConns), labels...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendConnectionsTotal, prometheus.CounterValue,
+				float64(s.Conns), labels...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendPacketsTotal, prometheus.CounterValue,
+				float64(s.PacketsIn), append(labels, "in")...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendPacketsTotal, prometheus.CounterValue,
+				float64(s.PacketsOut), append(labels, "out")...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendBytesTotal, prometheus.CounterValue,
+				float64(s.BytesIn), append(labels, "in")...)
+			ch <- prometheus.MustNewConstMetric(serviceBackendBytesTotal, prometheus.CounterValue,
+				float64(s.BytesOut), append(labels, "out")...)
+		}
+	}
+}
+
+// observePulseUpdate records the outcome of the last backend check and the
+// status transition it might have caused.
+func observePulseUpdate(vsID, rsID string, opts *BackendOptions, prev pulse.StatusType, m pulse.Metrics) {
+	port := fmt.Sprintf("%d", opts.Port)
+
+	serviceBackendCheckDuration.WithLabelValues(vsID, rsID, opts.Host, port).
+		Observe(m.Latency.Seconds())
+
+	// Consecutive successes are reset by the first failed check.
+	if m.Successes > 0 {
+		serviceBackendChecksTotal.WithLabelValues(vsID, rsID, opts.Host, port, "success", "").Inc()
+	} else {
+		serviceBackendChecksTotal.WithLabelValues(vsID, rsID, opts.Host, port, "failure", m.Reason).Inc()
+	}
+
+	if prev != m.Status {
+		serviceBackendTransitionsTotal.WithLabelValues(vsID, rsID, opts.Host, port,
+			prev.String(), m.Status.String()).Inc()
+	}
+}
+
+// forgetBackend deletes the series of a removed backend, so that they do not
+// linger in the exporter output. Vectors without fixed label values are
+// cleared for every combination that observePulseUpdate could have produced.
+func forgetBackend(vsID, rsID string, opts *BackendOptions) {
+	port := fmt.Sprintf("%d", opts.Port)
 
-			serviceBackendHealth.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Health)
+	serviceBackendUptimeTotal.DeleteLabelValues(vsID, rsID, opts.Host, port)
+	serviceBackendHealth.DeleteLabelValues(vsID, rsID, opts.Host, port)
+	serviceBackendStatus.DeleteLabelValues(vsID, rsID, opts.Host, port)
+	serviceBackendWeight.DeleteLabelValues(vsID, rsID, opts.Host, port)
+	serviceBackendCheckDuration.DeleteLabelValues(vsID, rsID, opts.Host, port)
 
-			serviceBackendStatus.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Metrics.Status))
+	serviceBackendChecksTotal.DeleteLabelValues(vsID, rsID, opts.Host, port, "success", "")
 
-			serviceBackendWeight.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Options.Weight))
+	for _, reason := range []string{
+		pulse.ReasonTimeout, pulse.ReasonConnection, pulse.ReasonResponse, pulse.ReasonError,
+	} {
+		serviceBackendChecksTotal.DeleteLabelValues(vsID, rsID, opts.Host, port, "failure", reason)
+	}
+
+	statuses := []pulse.StatusType{pulse.StatusUp, pulse.StatusDown, pulse.StatusRemoved}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			serviceBackendTransitionsTotal.DeleteLabelValues(vsID, rsID, opts.Host, port,
+				from.String(), to.String())
 		}
 	}
-	return nil
 }
+
+// forgetService deletes the series of a removed service.
+func forgetService(vsID string, opts *ServiceOptions) {
+	port := fmt.Sprintf("%d", opts.Port)
+
+	serviceHealth.DeleteLabelValues(vsID, opts.Host, port, opts.Protocol)
+	serviceBackends.DeleteLabelValues(vsID, opts.Host, port, opts.Protocol)
+}
+
 func RegisterPrometheusExporter(ctx *Context) {
 	prometheus.MustRegister(NewExporter(ctx))
 }
@@ -1,13 +1,26 @@
 package core
 
 import (
+	"net"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kobolog/gorb/pulse"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestCollector(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockIpvs.On("GetServiceStats", mock.Anything, mock.Anything, mock.Anything).Return(&ServiceStats{}, nil)
+
 	ctx := &Context{
+		ipvs:     mockIpvs,
 		services: make(map[string]*service),
 		backends: make(map[string]*backend),
 	}
@@ -26,8 +39,143 @@ func TestCollector(t *testing.T) {
 		VsID:   "service1",
 	}, service: ctx.services["service1"], monitor: &pulse.Pulse{}}
 	exporter := NewExporter(ctx)
-	err := exporter.collect()
-	if err != nil {
-		t.Fatal(err)
+	exporter.collect()
+
+	// IPVS stats are read by collectStats only.
+	mockIpvs.AssertNotCalled(t, "GetServiceStats", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceBackends.WithLabelValues("service1", "localhost", "1234", "tcp")))
+}
+
+func TestCollectStats(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockIpvs.On("GetServiceStats", "127.0.0.1", uint16(80), uint16(6)).Return(&ServiceStats{
+		Stats: Stats{ActiveConns: 3, Conns: 10, PacketsIn: 100, PacketsOut: 90, BytesIn: 1000, BytesOut: 9000},
+		Dests: map[string]Stats{"127.0.0.1:8080": {ActiveConns: 3, InactiveConns: 1, Conns: 10}},
+	}, nil)
+
+	ctx := &Context{
+		ipvs:     mockIpvs,
+		services: make(map[string]*service),
+		backends: make(map[string]*backend),
+	}
+	ctx.services["service3"] = &service{options: &ServiceOptions{Host: "127.0.0.1", Port: 80, Protocol: "tcp",
+		host: net.ParseIP("127.0.0.1"), protocol: 6}}
+	ctx.backends["backend1"] = &backend{options: &BackendOptions{Host: "127.0.0.1", Port: 8080,
+		host: net.ParseIP("127.0.0.1")}, service: ctx.services["service3"]}
+
+	ch := make(chan prometheus.Metric, 100)
+	NewExporter(ctx).collectStats(ch)
+	close(ch)
+
+	values := map[string]float64{}
+
+	for metric := range ch {
+		var m dto.Metric
+
+		metric.Write(&m)
+
+		name := metric.Desc().String()
+
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "direction" {
+				name += label.GetValue()
+			}
+		}
+
+		values[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+	}
+
+	assert.Len(t, values, 12)
+	assert.Equal(t, 10.0, values[serviceConnectionsTotal.String()])
+	assert.Equal(t, 90.0, values[servicePacketsTotal.String()+"out"])
+	assert.Equal(t, 9000.0, values[serviceBytesTotal.String()+"out"])
+	assert.Equal(t, 3.0, values[serviceBackendActiveConnections.String()])
+	assert.Equal(t, 1.0, values[serviceBackendInactiveConnections.String()])
+	assert.Equal(t, 10.0, values[serviceBackendConnectionsTotal.String()])
+}
+
+func TestCollectStatsFwMark(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockIpvs.On("GetFWMServiceStats", uint32(7), uint16(syscall.AF_INET)).Return(&ServiceStats{
+		Stats: Stats{Conns: 10}, Dests: map[string]Stats{}}, nil)
+
+	ctx := &Context{
+		ipvs:     mockIpvs,
+		services: make(map[string]*service),
+		backends: make(map[string]*backend),
+	}
+	ctx.services["service4"] = &service{options: &ServiceOptions{FwMark: 7, Family: "ipv4",
+		af: syscall.AF_INET}}
+
+	ch := make(chan prometheus.Metric, 100)
+	NewExporter(ctx).collectStats(ch)
+	close(ch)
+
+	metric := <-ch
+
+	var m dto.Metric
+	metric.Write(&m)
+
+	labels := map[string]string{}
+
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	assert.Equal(t, serviceConnectionsTotal.String(), metric.Desc().String())
+	assert.Equal(t, map[string]string{"name": "service4", "host": "", "port": "", "protocol": "",
+		"fwmark": "7"}, labels)
+	assert.Equal(t, 10.0, m.GetCounter().GetValue())
+}
+
+func TestObservePulseUpdate(t *testing.T) {
+	opts := &BackendOptions{Host: "localhost", Port: 1234}
+	defer forgetBackend("service2", "backend1", opts)
+
+	observePulseUpdate("service2", "backend1", opts, pulse.StatusUp, pulse.Metrics{
+		Status: pulse.StatusUp, Successes: 1, Latency: 20 * time.Millisecond})
+	observePulseUpdate("service2", "backend1", opts, pulse.StatusUp, pulse.Metrics{
+		Status: pulse.StatusDown, Failures: 1, Reason: pulse.ReasonTimeout, Latency: 5 * time.Second})
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceBackendChecksTotal.WithLabelValues(
+		"service2", "backend1", "localhost", "1234", "success", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceBackendChecksTotal.WithLabelValues(
+		"service2", "backend1", "localhost", "1234", "failure", "timeout")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceBackendTransitionsTotal.WithLabelValues(
+		"service2", "backend1", "localhost", "1234", "Up", "Down")))
+
+	var m dto.Metric
+
+	serviceBackendCheckDuration.WithLabelValues("service2", "backend1", "localhost", "1234").(prometheus.Metric).Write(&m)
+
+	assert.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 5.02, m.GetHistogram().GetSampleSum(), 1e-9)
+}
+
+func TestForgetBackend(t *testing.T) {
+	opts := &BackendOptions{Host: "localhost", Port: 4321}
+
+	observePulseUpdate("service3", "backend1", opts, pulse.StatusUp, pulse.Metrics{
+		Status: pulse.StatusDown, Failures: 1, Reason: pulse.ReasonConnection})
+	observePulseUpdate("service3", "backend1", opts, pulse.StatusDown, pulse.Metrics{
+		Status: pulse.StatusUp, Successes: 1})
+
+	forgetBackend("service3", "backend1", opts)
+
+	for _, c := range []prometheus.Collector{
+		serviceBackendCheckDuration, serviceBackendChecksTotal, serviceBackendTransitionsTotal,
+	} {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+
+		for metric := range ch {
+			var m dto.Metric
+			metric.Write(&m)
+
+			for _, l := range m.GetLabel() {
+				assert.NotEqual(t, "service3", l.GetValue())
+			}
+		}
 	}
 }
@@ -21,18 +21,51 @@
 package core
 
 import (
+	"time"
+
 	"github.com/kobolog/gorb/pulse"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// How often slow starting backend weights are updated.
+const rampInterval = time.Second
+
+// ramp is a backend weight ramp-up from the lowest weight to the full one.
+type ramp struct {
+	id     pulse.ID
+	since  time.Time
+	weight int32
+}
+
+// current returns the ramp weight at the given time.
+func (r *ramp) current(ts time.Time, duration time.Duration) int32 {
+	weight := int32(float64(r.weight) * float64(ts.Sub(r.since)) / float64(duration))
+
+	if weight < 1 {
+		// Zero weight would inhibit any traffic to the backend.
+		weight = 1
+	} else if weight > r.weight {
+		weight = r.weight
+	}
+
+	return weight
+}
+
 func (ctx *Context) run() {
-	stash := make(map[pulse.ID]int32)
+	stash := ctx.stash
+	ticker := time.NewTicker(rampInterval)
+
+	defer ticker.Stop()
 
 	for {
 		select {
 		case u := <-ctx.pulseCh:
 			ctx.processPulseUpdate(stash, u)
+		case batch := <-ctx.batchCh:
+			ctx.processPulseBatch(stash, batch)
+		case ts := <-ticker.C:
+			ctx.processRamps(stash, ts)
 		case <-ctx.stopCh:
 			log.Debug("notificationLoop has been stopped")
 			return
@@ -40,43 +73,163 @@ func (ctx *Context) run() {
 	}
 }
 
+// processRamps updates weights of slow starting backends.
+func (ctx *Context) processRamps(stash map[pulse.ID]int32, ts time.Time) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	for _, rs := range ctx.backends {
+		if rs.ramp == nil {
+			continue
+		}
+
+		id := rs.ramp.id
+		weight := rs.ramp.current(ts, rs.slowStart())
+
+		if weight == rs.ramp.weight {
+			log.Debugf("backend %s has finished slow start", id)
+
+			if rs.metrics.Penalty > 0 {
+				// Let the pulse updates handle the penalty from now on.
+				stash[id] = rs.ramp.weight
+			}
+
+			rs.ramp = nil
+		}
+
+		weight = int32(float64(weight) * (1 - rs.metrics.Penalty))
+
+		if weight == rs.options.Weight {
+			continue
+		}
+
+		if _, err := ctx.updateBackend(id.VsID, id.RsID, weight); err != nil {
+			log.Errorf("error while ramping up a backend: %s", err)
+		}
+	}
+}
+
 func (ctx *Context) processPulseUpdate(stash map[pulse.ID]int32, u pulse.Update) {
-	vsID, rsID := u.Source.VsID, u.Source.RsID
+	ctx.processPulseBatch(stash, []pulse.Update{u})
+}
+
+type transition struct {
+	update pulse.Update
+	prev   pulse.StatusType
+}
+
+// processPulseBatch applies a batch of pulse updates under a single lock.
+// Webhooks are notified once backend weights are updated and it's released.
+func (ctx *Context) processPulseBatch(stash map[pulse.ID]int32, batch []pulse.Update) {
+	var transitions []transition
 
 	ctx.mutex.Lock()
 
+	for _, shared := range batch {
+		for _, u := range ctx.fanOut(shared) {
+			if prev, changed := ctx.applyPulseUpdate(stash, u); changed {
+				transitions = append(transitions, transition{u, prev})
+			}
+		}
+	}
+
+	for id := range stash {
+		// Backends which no longer share a check don't get removal updates.
+		if _, exists := ctx.backends[id.RsID]; !exists {
+			delete(stash, id)
+		}
+	}
+
+	ctx.mutex.Unlock()
+
+	for _, t := range transitions {
+		ctx.notifyTransition(t.update.Source.VsID, t.update.Source.RsID, t.prev, t.update.Metrics)
+	}
+}
+
+// applyPulseUpdate must be called with the Context locked. It returns the
+// previous backend status and whether it has changed.
+func (ctx *Context) applyPulseUpdate(stash map[pulse.ID]int32, u pulse.Update) (pulse.StatusType, bool) {
+	if rs, exists := ctx.backends[u.Source.RsID]; exists && u.Metrics.Status != pulse.StatusRemoved {
+		observePulseUpdate(u.Source.VsID, u.Source.RsID, rs.options, rs.metrics.Status, u.Metrics)
+	}
+
+	return ctx.setPulseMetrics(stash, u)
+}
+
+// setPulseMetrics applies the pulse update without recording the check in
+// the exporter, e.g. for backends seeded with the metrics of a shared check.
+// Must be called with the Context locked.
+func (ctx *Context) setPulseMetrics(stash map[pulse.ID]int32, u pulse.Update) (pulse.StatusType, bool) {
+	vsID, rsID := u.Source.VsID, u.Source.RsID
+
 	// check exist
 	if _, ok := ctx.backends[rsID]; !ok || u.Metrics.Status == pulse.StatusRemoved {
 		if _, exists := stash[u.Source]; exists {
 			log.Debugf("backend %s has been deleted, so deleting it from stash too", u.Source)
 			delete(stash, u.Source)
 		}
-		ctx.mutex.Unlock()
-		return
+		return 0, false
 	}
 
-	if ctx.backends[rsID].metrics.Status != u.Metrics.Status {
+	rs := ctx.backends[rsID]
+	prev := rs.metrics.Status
+
+	if prev != u.Metrics.Status {
 		log.Warnf("backend %s status: %s", u.Source, u.Metrics.Status)
+
+		e := backendEvent(EventBackendStatus, vsID, rsID, rs.options.Weight)
+		e.Status = u.Metrics.Status.String()
+		ctx.events.publish(e)
 	}
 
+	recovered := prev == pulse.StatusDown && u.Metrics.Status == pulse.StatusUp
+
 	// This is a copy of metrics structure from Pulse.
-	ctx.backends[rsID].metrics = u.Metrics
+	rs.metrics = u.Metrics
 
-	ctx.mutex.Unlock()
+	if !rs.active() {
+		// Backends out of rotation keep their zero weight.
+		return prev, prev != u.Metrics.Status
+	}
+
+	// Current backend weight, which is the full one unless it's stashed.
+	current := rs.options.Weight
+
+	// Slow starting backends are handled by processRamps.
+	ramping, started := rs.ramp, false
+
+	if ramping != nil && u.Metrics.Status == pulse.StatusDown {
+		// The full weight is stashed instead of the partial one.
+		rs.ramp, stash[u.Source] = nil, ramping.weight
+	} else if weight, exists := stash[u.Source]; exists && recovered && rs.slowStart() != 0 {
+		// Replaces the health-proportional formula for recovering backends.
+		rs.ramp, started = &ramp{u.Source, time.Now(), weight}, true
+		delete(stash, u.Source)
+	}
 
 	switch u.Metrics.Status {
 	case pulse.StatusUp:
+		if ramping != nil || started {
+			break
+		}
+
 		// Weight is gonna be stashed until the backend is recovered.
 		weight, exists := stash[u.Source]
 
 		if !exists {
-			return
+			if u.Metrics.Penalty == 0 {
+				break
+			}
+
+			// The backend asked to shed some load, so stash its full weight.
+			weight, stash[u.Source] = current, current
 		}
 
-		// Calculate a relative weight considering backend's health.
-		weight = int32(float64(weight) * u.Metrics.Health)
+		// Calculate a relative weight considering backend's health and penalty.
+		weight = int32(float64(weight) * u.Metrics.Health * (1 - u.Metrics.Penalty))
 
-		if _, err := ctx.UpdateBackend(vsID, rsID, weight); err != nil {
+		if _, err := ctx.updateBackend(vsID, rsID, weight); err != nil {
 			log.Errorf("error while unstashing a backend: %s", err)
 		} else if weight == stash[u.Source] {
 			log.Debugf("backend %s has completely recovered, so deleting it from stash.", u.Source)
@@ -85,14 +238,16 @@ func (ctx *Context) processPulseUpdate(stash map[pulse.ID]int32, u pulse.Update)
 		}
 
 	case pulse.StatusDown:
-		if _, exists := stash[u.Source]; exists {
-			return
+		if _, exists := stash[u.Source]; exists && ramping == nil {
+			break
 		}
 
-		if weight, err := ctx.UpdateBackend(vsID, rsID, 0); err != nil {
+		if weight, err := ctx.updateBackend(vsID, rsID, 0); err != nil {
 			log.Errorf("error while stashing a backend: %s", err)
-		} else {
+		} else if ramping == nil {
 			stash[u.Source] = weight
 		}
 	}
+
+	return prev, prev != u.Metrics.Status
 }
@@ -0,0 +1,66 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+	"strconv"
+)
+
+// Stats are IPVS traffic counters and rates of a virtual service or backend.
+type Stats struct {
+	ActiveConns   uint64 `json:"active_conns"`
+	InactiveConns uint64 `json:"inactive_conns"`
+	Conns         uint64 `json:"conns"`
+	PacketsIn     uint64 `json:"packets_in"`
+	PacketsOut    uint64 `json:"packets_out"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+
+	// Rates per second estimated by IPVS.
+	CPS    uint64 `json:"cps"`
+	PPSIn  uint64 `json:"pps_in"`
+	PPSOut uint64 `json:"pps_out"`
+	BPSIn  uint64 `json:"bps_in"`
+	BPSOut uint64 `json:"bps_out"`
+}
+
+// ServiceStats are stats of a virtual service along with its backends,
+// keyed by their host:port addresses.
+type ServiceStats struct {
+	Stats
+	Dests map[string]Stats
+}
+
+// destKey returns the key of the backend's stats in ServiceStats.
+func destKey(ip string, port uint16) string {
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+// serviceStats reads the virtual service stats from IPVS. Must be called
+// with the Context locked.
+func (ctx *Context) serviceStats(vs *ServiceOptions) (*ServiceStats, error) {
+	if vs.FwMark != 0 {
+		return ctx.ipvs.GetFWMServiceStats(vs.FwMark, vs.af)
+	}
+
+	return ctx.ipvs.GetServiceStats(vs.host.String(), vs.Port, vs.protocol)
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/docker/libkv"
 	libkvmock "github.com/docker/libkv/store/mock"
 	"github.com/docker/libkv/store"
@@ -59,3 +60,26 @@ func TestErrorIfPathMismatch(t *testing.T) {
 
 	assert.Error(err)
 }
+
+func TestSetStoreWritesAdoptedEntries(t *testing.T) {
+	m := storeMock{}
+	s := &Store{kvstore: &m.Mock, storeServicePath: "/services", storeBackendPath: "/backends"}
+
+	c := newContext(&fakeIpvs{}, &fakeDisco{})
+	c.services["adopted"] = &service{options: &ServiceOptions{Host: "127.0.0.1", Port: 80}, adopted: true}
+	c.services["created"] = &service{options: &ServiceOptions{Host: "127.0.0.1", Port: 81}}
+	c.backends["rs1"] = &backend{options: &BackendOptions{Host: "127.0.0.1", Port: 8080, VsID: "adopted"},
+		service: c.services["adopted"], adopted: true}
+
+	m.On("Exists", "/services/adopted").Return(false, nil)
+	m.On("Put", "/services/adopted", mock.Anything, mock.Anything).Return(nil)
+	m.On("Exists", "/backends/rs1").Return(false, nil)
+	m.On("Put", "/backends/rs1", mock.Anything, mock.Anything).Return(nil)
+
+	// Otherwise adopted services and backends would be removed by the first sync.
+	c.SetStore(s)
+
+	assert.Equal(t, s, c.store)
+	m.AssertExpectations(t)
+	m.AssertNotCalled(t, "Exists", "/services/created")
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kobolog/gorb/pulse"
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Notifications which can't be delivered after this many attempts
+	// are dropped. The delay between attempts doubles every time.
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+
+	// Number of notifications waiting for delivery to each webhook.
+	webhookQueue = 1024
+)
+
+// WebhookPayload is POSTed to webhooks on backend status transitions.
+type WebhookPayload struct {
+	Service   string    `json:"service"`
+	Backend   string    `json:"backend"`
+	OldStatus string    `json:"old_status"`
+	NewStatus string    `json:"new_status"`
+	Health    float64   `json:"health"`
+	Weight    int32     `json:"weight"`
+	Time      time.Time `json:"time"`
+}
+
+type delivery struct {
+	hook    WebhookOptions
+	body    []byte
+	attempt int
+}
+
+// notifier delivers webhook notifications in the background, retrying
+// failed deliveries with exponential back-off. Every webhook has its own
+// queue, so that slow ones don't hold up the others.
+type notifier struct {
+	client  http.Client
+	backoff time.Duration
+	stopCh  chan struct{}
+
+	mutex  sync.Mutex
+	queues map[string]chan *delivery
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		client:  http.Client{Timeout: 5 * time.Second},
+		backoff: webhookBackoff,
+		stopCh:  make(chan struct{}),
+		queues:  make(map[string]chan *delivery),
+	}
+}
+
+func (n *notifier) notify(hooks []WebhookOptions, payload WebhookPayload) {
+	body := util.MustMarshal(payload, util.JSONOptions{})
+
+	for _, hook := range hooks {
+		n.enqueue(&delivery{hook: hook, body: body})
+	}
+}
+
+func (n *notifier) enqueue(d *delivery) {
+	select {
+	case n.queue(d.hook.URL) <- d:
+	case <-n.stopCh:
+	default:
+		log.Errorf("webhook queue is full, dropping notification for %s", d.hook.URL)
+	}
+}
+
+// queue returns the delivery queue of the webhook, starting its delivery
+// goroutine on first use.
+func (n *notifier) queue(url string) chan *delivery {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	q, exists := n.queues[url]
+
+	if !exists {
+		q = make(chan *delivery, webhookQueue)
+		n.queues[url] = q
+
+		go n.run(q)
+	}
+
+	return q
+}
+
+func (n *notifier) run(q chan *delivery) {
+	for {
+		select {
+		case d := <-q:
+			n.deliver(d)
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *notifier) deliver(d *delivery) {
+	err := n.post(d)
+	if err == nil {
+		return
+	}
+
+	if d.attempt++; d.attempt >= webhookAttempts {
+		log.Errorf("giving up on webhook %s after %d attempts: %s", d.hook.URL, d.attempt, err)
+		return
+	}
+
+	delay := n.backoff << uint(d.attempt-1)
+
+	log.Warnf("error while notifying webhook %s, retrying in %s: %s", d.hook.URL, delay, err)
+
+	time.AfterFunc(delay, func() { n.enqueue(d) })
+}
+
+func (n *notifier) post(d *delivery) error {
+	rq, err := http.NewRequest("POST", d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	rq.Header.Set("Content-Type", "application/json")
+
+	if len(d.hook.Secret) != 0 {
+		rq.Header.Set("X-Gorb-Signature", "sha256="+sign(d.hook.Secret, d.body))
+	}
+
+	r, err := n.client.Do(rq)
+	if err != nil {
+		return err
+	}
+
+	r.Body.Close()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return fmt.Errorf("received %d status code", r.StatusCode)
+	}
+
+	return nil
+}
+
+func (n *notifier) stop() {
+	close(n.stopCh)
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyTransition sends the backend status transition to global and
+// virtual service webhooks.
+func (ctx *Context) notifyTransition(vsID, rsID string, prev pulse.StatusType, m pulse.Metrics) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	rs, exists := ctx.backends[rsID]
+
+	if !exists || ctx.notifier == nil {
+		return
+	}
+
+	hooks := append(append([]WebhookOptions(nil), ctx.webhooks...),
+		rs.service.options.Webhooks...)
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	ctx.notifier.notify(hooks, WebhookPayload{
+		Service:   vsID,
+		Backend:   rsID,
+		OldStatus: prev.String(),
+		NewStatus: m.Status.String(),
+		Health:    m.Health,
+		Weight:    rs.options.Weight,
+		Time:      m.LastChange,
+	})
+}
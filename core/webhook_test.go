@@ -0,0 +1,120 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kobolog/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateWebhookOptions(t *testing.T) {
+	assert.NoError(t, (&WebhookOptions{URL: "https://example.com/hook"}).Validate())
+
+	for _, u := range []string{"", "example.com/hook", "ftp://example.com", "http://"} {
+		assert.Equal(t, ErrInvalidWebhook, (&WebhookOptions{URL: u}).Validate(), u)
+	}
+}
+
+func TestWebhookIsNotifiedOnStatusTransition(t *testing.T) {
+	type request struct {
+		signature string
+		body      []byte
+	}
+
+	var (
+		requests = make(chan request, 10)
+		attempts int
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Header.Get("X-Gorb-Signature"), body}
+
+		// The first delivery attempt fails.
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer ts.Close()
+
+	stash := make(map[pulse.ID]int32)
+	vs := &service{options: &ServiceOptions{Webhooks: []WebhookOptions{{URL: ts.URL, Secret: "secret"}}}}
+	backends := map[string]*backend{rsID: &backend{service: vs, options: &BackendOptions{Weight: 100}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+	c.notifier = newNotifier()
+	c.notifier.backoff = 10 * time.Millisecond
+
+	defer c.notifier.stop()
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(0), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusDown, Health: 0.5}})
+
+	<-requests
+	r := <-requests
+
+	assert.Equal(t, "sha256="+sign("secret", r.body), r.signature)
+
+	var payload WebhookPayload
+
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, vsID, payload.Service)
+	assert.Equal(t, rsID, payload.Backend)
+	assert.Equal(t, "Up", payload.OldStatus)
+	assert.Equal(t, "Down", payload.NewStatus)
+	assert.Equal(t, 0.5, payload.Health)
+	assert.Equal(t, int32(0), payload.Weight)
+
+	// No notifications without transitions.
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+
+	select {
+	case <-requests:
+		t.Fatal("unexpected notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSlowWebhookDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	defer slow.Close()
+	defer close(release)
+
+	delivered := make(chan struct{}, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+
+	defer fast.Close()
+
+	n := newNotifier()
+	defer n.stop()
+
+	hooks := []WebhookOptions{{URL: slow.URL}, {URL: fast.URL}}
+
+	for i := 0; i < 2; i++ {
+		n.notify(hooks, WebhookPayload{Service: vsID, Backend: rsID})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("notification is held up by another webhook")
+		}
+	}
+}
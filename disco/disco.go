@@ -21,15 +21,71 @@
 package disco
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
 	"github.com/kobolog/gorb/util"
 )
 
+// ErrUnknownDriver is returned for unregistered Discovery types.
+var ErrUnknownDriver = errors.New("specified discovery type is unknown")
+
 // Driver provides the actual implementation for the Discovery.
 type Driver interface {
 	Expose(name, host string, port uint16) error
 	Remove(name string) error
 }
 
+// DriverFactory creates a Driver from the Discovery arguments.
+type DriverFactory func(args util.DynamicMap) (Driver, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]DriverFactory{
+		"consul": newConsulDriver,
+		"none":   newNoopDriver,
+	}
+)
+
+// RegisterDriver makes a Discovery driver available under the given name,
+// which is case-insensitive. It's meant to be called from init functions,
+// so it panics if the name is empty or already taken.
+func RegisterDriver(name string, factory DriverFactory) {
+	name = strings.ToLower(name)
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if len(name) == 0 || factory == nil {
+		panic(fmt.Sprintf("disco: invalid driver registration for %q", name))
+	}
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("disco: driver %q is already registered", name))
+	}
+
+	registry[name] = factory
+}
+
+// Drivers returns a sorted list of registered driver names.
+func Drivers() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	r := make([]string, 0, len(registry))
+
+	for name := range registry {
+		r = append(r, name)
+	}
+
+	sort.Strings(r)
+
+	return r
+}
+
 // Options contain Discovery configuration.
 type Options struct {
 	Type string
@@ -38,16 +94,23 @@ type Options struct {
 
 // New creates a new Discovery from the provided options.
 func New(opts *Options) (Driver, error) {
-	switch opts.Type {
-	case "consul":
-		return newConsulDriver(opts.Args)
-	default:
-		return &noopDriver{}, nil
+	registryMutex.RLock()
+	factory := registry[strings.ToLower(opts.Type)]
+	registryMutex.RUnlock()
+
+	if factory == nil {
+		return nil, ErrUnknownDriver
 	}
+
+	return factory(opts.Args)
 }
 
 type noopDriver struct{}
 
+func newNoopDriver(args util.DynamicMap) (Driver, error) {
+	return &noopDriver{}, nil
+}
+
 func (d *noopDriver) Expose(name, host string, port uint16) error {
 	return nil
 }
@@ -122,3 +122,20 @@ func TestConsulDriverInvalidURL(t *testing.T) {
 	assert.Error(t, cd.Expose("name", "host", 1024))
 	assert.Error(t, cd.Remove("name"))
 }
+
+func TestDriverRegistry(t *testing.T) {
+	RegisterDriver("Custom", func(args util.DynamicMap) (Driver, error) {
+		return &noopDriver{}, nil
+	})
+
+	assert.Equal(t, []string{"consul", "custom", "none"}, Drivers())
+
+	_, err := New(&Options{Type: "custom"})
+	assert.NoError(t, err)
+
+	_, err = New(&Options{Type: "unknown"})
+	assert.Equal(t, ErrUnknownDriver, err)
+
+	assert.Panics(t, func() { RegisterDriver("consul", newConsulDriver) })
+	assert.Panics(t, func() { RegisterDriver("", newConsulDriver) })
+}
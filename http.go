@@ -22,14 +22,26 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/kobolog/gorb/core"
+	"github.com/kobolog/gorb/disco"
+	"github.com/kobolog/gorb/pulse"
 	"github.com/kobolog/gorb/util"
 
 	"github.com/gorilla/mux"
 )
 
+var (
+	errStreamingUnsupported = errors.New("streaming is not supported")
+	errInvalidEventID       = errors.New("event ID must be a non-negative integer")
+)
+
 type errorResponse struct {
 	Error string `json:"error"`
 }
@@ -98,14 +110,29 @@ type backendUpdateHandler struct {
 
 func (h backendUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var (
-		opts core.BackendOptions
+		opts struct {
+			Weight *int32 `json:"weight"`
+			State  string `json:"state"`
+		}
 		vars = mux.Vars(r)
 	)
 
 	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
 		writeError(w, err)
-	} else if _, err := h.ctx.UpdateBackend(vars["vsID"], vars["rsID"], opts.Weight); err != nil {
-		writeError(w, err)
+		return
+	}
+
+	if len(opts.State) != 0 {
+		if err := h.ctx.SetBackendState(vars["vsID"], vars["rsID"], opts.State); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if opts.Weight != nil {
+		if _, err := h.ctx.UpdateBackend(vars["vsID"], vars["rsID"], *opts.Weight); err != nil {
+			writeError(w, err)
+		}
 	}
 }
 
@@ -172,3 +199,101 @@ func (h backendStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		writeJSON(w, opts)
 	}
 }
+
+type driverList struct {
+	Pulse []string `json:"pulse"`
+	Disco []string `json:"disco"`
+}
+
+type driverListHandler struct{}
+
+func (h driverListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, driverList{pulse.Drivers(), disco.Drivers()})
+}
+
+type ipvsTableHandler struct {
+	ctx *core.Context
+}
+
+func (h ipvsTableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if table, err := h.ctx.IpvsTable(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, table)
+	}
+}
+
+type eventStreamHandler struct {
+	ctx *core.Context
+}
+
+// How often idle event streams are kept alive.
+const eventKeepAlive = 15 * time.Second
+
+func (h eventStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errStreamingUnsupported)
+		return
+	}
+
+	// Reconnecting clients replay events missed since the last one they got.
+	since := r.Header.Get("Last-Event-ID")
+	if len(since) == 0 {
+		since = r.URL.Query().Get("since")
+	}
+
+	var lastID uint64
+
+	if len(since) != 0 {
+		var err error
+
+		if lastID, err = strconv.ParseUint(since, 10, 64); err != nil {
+			writeError(w, errInvalidEventID)
+			return
+		}
+	}
+
+	replay, sub := h.ctx.Subscribe(r.URL.Query().Get("service"), lastID)
+	defer sub.Close()
+
+	if len(since) == 0 {
+		// Fresh clients are only interested in new events.
+		replay = nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, e := range replay {
+		writeEvent(w, e)
+	}
+
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// Too slow, the client will have to reconnect.
+				return
+			}
+
+			writeEvent(w, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e core.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type,
+		util.MustMarshal(e, util.JSONOptions{}))
+}
@@ -27,6 +27,7 @@ import (
 	"os"
 
 	"github.com/kobolog/gorb/core"
+	"github.com/kobolog/gorb/pulse"
 	"github.com/kobolog/gorb/util"
 
 	log "github.com/Sirupsen/logrus"
@@ -43,6 +44,8 @@ var (
 	debug            = flag.Bool("v", false, "enable verbose output")
 	device           = flag.String("i", "eth0", "default interface to bind services on")
 	flush            = flag.Bool("f", false, "flush IPVS pools on start")
+	ipvsDriver       = flag.String("ipvs", "gnl2go", "IPVS client, either gnl2go or netlink")
+	dryRun           = flag.Bool("dry-run", false, "simulate IPVS in memory, which doesn't require root privileges")
 	listen           = flag.String("l", ":4672", "endpoint to listen for HTTP requests")
 	consul           = flag.String("c", "", "URL for Consul HTTP API")
 	vipInterface     = flag.String("vipi", "", "interface to add VIPs")
@@ -51,6 +54,14 @@ var (
 	storeTimeout     = flag.Int64("store-sync-time", 60, "sync-time for store")
 	storeServicePath = flag.String("store-service-path", "services", "store service path")
 	storeBackendPath = flag.String("store-backend-path", "backends", "store backend path")
+	webhookURLs      = flag.String("webhook", "", "comma delimited list of webhook URLs notified on backend status transitions")
+	webhookSecret    = flag.String("webhook-secret", "", "secret to sign webhook payloads with")
+	pulseWorkers     = flag.Int("pulse-workers", 0, "number of concurrent health checks, 0 to run every health check in its own goroutine")
+	pulseRate        = flag.Float64("pulse-rate", 0, "maximum number of health checks started per second, 0 for no limit")
+	adopt            = flag.Bool("adopt", false, "import existing IPVS pools on start")
+	adoptPulse       = flag.String("adopt-pulse", "none", "pulse type of adopted backends")
+	driftInterval    = flag.Duration("drift-interval", 0, "interval of checks for out-of-band IPVS changes, 0 to disable")
+	driftRepair      = flag.Bool("drift-repair", false, "revert out-of-band IPVS changes")
 )
 
 func main() {
@@ -63,7 +74,9 @@ func main() {
 
 	log.Info("starting GORB Daemon v" + Version)
 
-	if os.Geteuid() != 0 {
+	if *dryRun {
+		log.Warn("running dry, no changes will be made to IPVS and network interfaces")
+	} else if os.Geteuid() != 0 {
 		log.Fatalf("this program has to be run with root priveleges to access IPVS")
 	}
 
@@ -82,12 +95,29 @@ func main() {
 		listenPort = uint16(listenAddr.Port)
 	}
 
+	var webhooks []core.WebhookOptions
+
+	if len(*webhookURLs) > 0 {
+		for _, u := range strings.Split(*webhookURLs, ",") {
+			webhooks = append(webhooks, core.WebhookOptions{URL: u, Secret: *webhookSecret})
+		}
+	}
+
 	ctx, err := core.NewContext(core.ContextOptions{
+		IpvsDriver:       *ipvsDriver,
+		DryRun:           *dryRun,
 		Disco:            *consul,
 		Endpoints:        hostIPs,
 		Flush:            *flush,
 		ListenPort:       listenPort,
-		VipInterface:     *vipInterface})
+		VipInterface:     *vipInterface,
+		Webhooks:         webhooks,
+		PulseWorkers:     *pulseWorkers,
+		PulseRate:        *pulseRate,
+		Adopt:            *adopt,
+		AdoptPulse:       &pulse.Options{Type: *adoptPulse},
+		DriftInterval:    *driftInterval,
+		DriftRepair:      *driftRepair})
 
 	if err != nil {
 		log.Fatalf("error while initializing server context: %s", err)
@@ -117,8 +147,14 @@ func main() {
 	r.Handle("/service", serviceListHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}", serviceStatusHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}/{rsID}", backendStatusHandler{ctx}).Methods("GET")
+	r.Handle("/drivers", driverListHandler{}).Methods("GET")
+	r.Handle("/events", eventStreamHandler{ctx}).Methods("GET")
 	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
+	if *dryRun {
+		r.Handle("/debug/ipvs", ipvsTableHandler{ctx}).Methods("GET")
+	}
+
 	log.Infof("setting up HTTP server on %s", *listen)
 	log.Fatal(http.ListenAndServe(*listen, r))
 }
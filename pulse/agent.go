@@ -0,0 +1,203 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kobolog/gorb/util"
+)
+
+var (
+	errUnknownAgentProtocol = errors.New("agent protocol must be either tcp or http")
+	errEmptyAgentReply      = errors.New("agent reply has no known keywords")
+)
+
+// Only this much of the agent reply is read.
+const maxAgentReplyLength = 1024
+
+type agentPulse struct {
+	Driver
+
+	endpoint string
+	protocol string
+	send     string
+	client   http.Client
+	target   string
+}
+
+func newAgentDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	pulseHost := opts.Get("host", host).(string)
+
+	pulsePort, err := portArg(opts, "port", port)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &agentPulse{
+		endpoint: fmt.Sprintf("%s:%d", pulseHost, pulsePort),
+		protocol: strings.ToLower(opts.Get("protocol", "tcp").(string)),
+		send:     opts.Get("send", "").(string),
+	}
+
+	switch p.protocol {
+	case "tcp":
+	case "http":
+		u := url.URL{
+			Scheme: "http",
+			Host:   p.endpoint,
+			Path:   opts.Get("path", "/").(string)}
+
+		p.target = u.String()
+	default:
+		return nil, errUnknownAgentProtocol
+	}
+
+	return p, nil
+}
+
+func (p *agentPulse) Check(ctx context.Context) Result {
+	reply, err := p.fetch(ctx)
+	if err != nil {
+		return failure(ReasonConnection, "error while querying agent at %s: %s", p.endpoint, err)
+	}
+
+	message := strings.TrimSpace(reply)
+
+	status, penalty, err := parseAgentReply(message)
+	if err != nil {
+		return failure(ReasonResponse, "error while querying agent at %s: %s", p.endpoint, err)
+	}
+
+	return Result{Status: status, Message: message, Penalty: penalty}
+}
+
+// fetch reads a single line reply from the agent.
+func (p *agentPulse) fetch(ctx context.Context) (string, error) {
+	var body io.ReadCloser
+
+	if p.protocol == "http" {
+		rq, err := http.NewRequest("GET", p.target, nil)
+		if err != nil {
+			return "", err
+		}
+
+		r, err := p.client.Do(rq.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+
+		if r.StatusCode != http.StatusOK {
+			r.Body.Close()
+			return "", fmt.Errorf("received %d status code", r.StatusCode)
+		}
+
+		body = r.Body
+	} else {
+		var d net.Dialer
+
+		socket, err := d.DialContext(ctx, "tcp", p.endpoint)
+		if err != nil {
+			return "", err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			socket.SetDeadline(deadline)
+		}
+
+		if len(p.send) != 0 {
+			if _, err := socket.Write([]byte(p.send)); err != nil {
+				socket.Close()
+				return "", err
+			}
+		}
+
+		body = socket
+	}
+
+	defer body.Close()
+
+	reply, err := bufio.NewReader(io.LimitReader(body, maxAgentReplyLength)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return reply, nil
+}
+
+// parseAgentReply interprets HAProxy-style agent replies: a list of
+// keywords and a weight percentage separated by spaces or commas.
+func parseAgentReply(reply string) (StatusType, float64, error) {
+	var (
+		status  = StatusUp
+		penalty float64
+		known   bool
+	)
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(reply), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t'
+	}) {
+		switch word {
+		case "up", "ready":
+		case "drain":
+			// Keep existing connections, but accept no new ones.
+			penalty = 1
+		case "down", "fail", "stopped", "maint":
+			status = StatusDown
+		default:
+			if !strings.HasSuffix(word, "%") {
+				// Unknown words like descriptions are ignored.
+				continue
+			}
+
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(word, "%"), 64)
+			if err != nil || percent < 0 {
+				return StatusDown, 0, fmt.Errorf("invalid weight: %s", word)
+			}
+
+			if percent > 100 {
+				// Backends can't have more weight than configured.
+				percent = 100
+			}
+
+			if penalty < 1 {
+				penalty = 1 - percent/100
+			}
+		}
+
+		known = true
+	}
+
+	if !known {
+		return StatusDown, 0, errEmptyAgentReply
+	}
+
+	return status, penalty, nil
+}
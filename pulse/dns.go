@@ -0,0 +1,224 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/kobolog/gorb/util"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	errUnknownQueryType = errors.New("specified DNS query type is unknown")
+	errUnknownRCode     = errors.New("specified DNS response code is unknown")
+	errUnknownProtocol  = errors.New("DNS protocol must be either udp or tcp")
+)
+
+var (
+	dnsTypes = map[string]dnsmessage.Type{
+		"A":     dnsmessage.TypeA,
+		"AAAA":  dnsmessage.TypeAAAA,
+		"CNAME": dnsmessage.TypeCNAME,
+		"MX":    dnsmessage.TypeMX,
+		"NS":    dnsmessage.TypeNS,
+		"PTR":   dnsmessage.TypePTR,
+		"SOA":   dnsmessage.TypeSOA,
+		"SRV":   dnsmessage.TypeSRV,
+		"TXT":   dnsmessage.TypeTXT,
+	}
+
+	dnsRCodes = map[string]dnsmessage.RCode{
+		"NOERROR":  dnsmessage.RCodeSuccess,
+		"FORMERR":  dnsmessage.RCodeFormatError,
+		"SERVFAIL": dnsmessage.RCodeServerFailure,
+		"NXDOMAIN": dnsmessage.RCodeNameError,
+		"NOTIMP":   dnsmessage.RCodeNotImplemented,
+		"REFUSED":  dnsmessage.RCodeRefused,
+	}
+)
+
+type dnsPulse struct {
+	Driver
+
+	endpoint string
+	protocol string
+	question dnsmessage.Question
+	rcode    dnsmessage.RCode
+	answer   *regexp.Regexp
+}
+
+func newDNSDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	p := &dnsPulse{
+		endpoint: fmt.Sprintf("%s:%d", host, port),
+		protocol: strings.ToLower(opts.Get("protocol", "udp").(string)),
+	}
+
+	if p.protocol != "udp" && p.protocol != "tcp" {
+		return nil, errUnknownProtocol
+	}
+
+	name := opts.Get("name", ".").(string)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	qtype, exists := dnsTypes[strings.ToUpper(opts.Get("type", "NS").(string))]
+	if !exists {
+		return nil, errUnknownQueryType
+	}
+
+	p.question = dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+
+	if p.rcode, exists = dnsRCodes[strings.ToUpper(opts.Get("rcode", "NOERROR").(string))]; !exists {
+		return nil, errUnknownRCode
+	}
+
+	if re := opts.Get("answer", "").(string); len(re) != 0 {
+		if p.answer, err = regexp.Compile(re); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *dnsPulse) Check(ctx context.Context) Result {
+	r, err := p.query(ctx)
+	if err != nil {
+		return failure(ReasonConnection, "error while querying %s: %s", p.endpoint, err)
+	} else if r.RCode != p.rcode {
+		return failure(ReasonResponse, "received %s instead of %s from %s", r.RCode, p.rcode, p.endpoint)
+	} else if p.answer != nil && !p.matchAnswer(r.Answers) {
+		return failure(ReasonResponse, "no answer from %s matches %q", p.endpoint, p.answer)
+	}
+
+	return Result{Status: StatusUp}
+}
+
+func (p *dnsPulse) query(ctx context.Context) (*dnsmessage.Message, error) {
+	id := uint16(rand.Int31n(1 << 16))
+
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{p.question},
+	}
+
+	packet, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+
+	socket, err := d.DialContext(ctx, p.protocol, p.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	defer socket.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		socket.SetDeadline(deadline)
+	}
+
+	if p.protocol == "tcp" {
+		// DNS over TCP messages are prefixed with a two byte length.
+		packet = append([]byte{byte(len(packet) >> 8), byte(len(packet))}, packet...)
+	}
+
+	if _, err := socket.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 65535)
+
+	var n int
+
+	if p.protocol == "tcp" {
+		if _, err = io.ReadFull(socket, buffer[:2]); err == nil {
+			n, err = io.ReadFull(socket, buffer[:binary.BigEndian.Uint16(buffer)])
+		}
+	} else {
+		n, err = socket.Read(buffer)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var r dnsmessage.Message
+
+	if err := r.Unpack(buffer[:n]); err != nil {
+		return nil, err
+	} else if r.ID != id {
+		return nil, fmt.Errorf("response ID %d doesn't match query ID %d", r.ID, id)
+	}
+
+	return &r, nil
+}
+
+func (p *dnsPulse) matchAnswer(answers []dnsmessage.Resource) bool {
+	for _, a := range answers {
+		var value string
+
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			value = net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			value = net.IP(body.AAAA[:]).String()
+		case *dnsmessage.CNAMEResource:
+			value = body.CNAME.String()
+		case *dnsmessage.MXResource:
+			value = body.MX.String()
+		case *dnsmessage.NSResource:
+			value = body.NS.String()
+		case *dnsmessage.PTRResource:
+			value = body.PTR.String()
+		case *dnsmessage.SRVResource:
+			value = body.Target.String()
+		case *dnsmessage.TXTResource:
+			value = strings.Join(body.TXT, "")
+		default:
+			continue
+		}
+
+		if p.answer.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
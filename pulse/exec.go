@@ -0,0 +1,162 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+)
+
+var (
+	errMissingCommand = errors.New("command must be a non-empty string or array of strings")
+	errInvalidPenalty = errors.New("warning penalty must be between 0 and 1")
+)
+
+// Only this much of the command output is kept as the check message.
+const maxMessageLength = 4096
+
+// How long to wait for the output to be closed once the command is killed.
+const execWaitDelay = time.Second
+
+type execPulse struct {
+	Driver
+
+	command []string
+	env     []string
+
+	// Exit code which means the backend is up, but degraded.
+	warning int
+	penalty float64
+}
+
+func newExecDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	command, err := parseCommand(opts["command"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Placeholders are expanded in command arguments.
+	r := strings.NewReplacer("{host}", host, "{port}", strconv.Itoa(int(port)))
+
+	for i := range command {
+		command[i] = r.Replace(command[i])
+	}
+
+	p := &execPulse{
+		command: command,
+		env: append(os.Environ(),
+			fmt.Sprintf("GORB_HOST=%s", host),
+			fmt.Sprintf("GORB_PORT=%d", port)),
+	}
+
+	if p.warning, err = intArg(opts, "warning_code", 1); err != nil {
+		return nil, err
+	}
+
+	if p.penalty, err = floatArg(opts, "warning_penalty", 0); err != nil {
+		return nil, err
+	}
+
+	if p.penalty < 0 || p.penalty > 1 {
+		return nil, errInvalidPenalty
+	}
+
+	return p, nil
+}
+
+func (p *execPulse) Check(ctx context.Context) Result {
+	var stdout bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Env, cmd.Stdout = p.env, &stdout
+
+	// Processes forked by the command are killed along with it, otherwise
+	// they would keep the output open and the check would hang.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = execWaitDelay
+
+	err := cmd.Run()
+
+	if stdout.Len() > maxMessageLength {
+		stdout.Truncate(maxMessageLength)
+	}
+
+	message := strings.TrimSpace(stdout.String())
+
+	if err == nil {
+		return Result{Status: StatusUp, Message: message}
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		if exitErr.ExitCode() == p.warning {
+			return Result{Status: StatusUp, Message: message, Penalty: p.penalty}
+		}
+	}
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	if len(message) == 0 {
+		return failure(ReasonError, "command %s failed: %s", p.command[0], err)
+	}
+
+	return Result{Status: StatusDown, Reason: ReasonResponse, Message: message}
+}
+
+// parseCommand accepts either a single executable or an array of strings.
+func parseCommand(v interface{}) ([]string, error) {
+	var command []string
+
+	switch v := v.(type) {
+	case string:
+		command = []string{v}
+	case []string:
+		command = append(command, v...)
+	case []interface{}:
+		for _, arg := range v {
+			if s, ok := arg.(string); ok {
+				command = append(command, s)
+			} else {
+				return nil, errMissingCommand
+			}
+		}
+	}
+
+	if len(command) == 0 || len(command[0]) == 0 {
+		return nil, errMissingCommand
+	}
+
+	return command, nil
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+var errGRPCClosed = errors.New("pulse is stopped")
+
+// Reconnects are attempted at least this often, so that a recovered backend
+// isn't reported down for long.
+const grpcMaxBackoff = 5 * time.Second
+
+type grpcPulse struct {
+	Driver
+
+	endpoint string
+	service  string
+	dialOpt  grpc.DialOption
+	metadata metadata.MD
+
+	// Connection is kept between checks and closed when the Pulse is stopped.
+	mutex  sync.Mutex
+	conn   *grpc.ClientConn
+	closed bool
+}
+
+func newGRPCDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	pulseHost := opts.Get("host", host).(string)
+
+	pulsePort, err := portArg(opts, "port", port)
+	if err != nil {
+		return nil, err
+	}
+
+	useTLS, err := boolArg(opts, "tls", false)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &grpcPulse{
+		endpoint: fmt.Sprintf("%s:%d", pulseHost, pulsePort),
+		service:  opts.Get("service", "").(string),
+		dialOpt:  grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+
+	if useTLS {
+		tlsConfig, err := newTLSConfig(pulseHost, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		p.dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+
+	md, err := parseHeaders(opts["metadata"])
+	if err != nil {
+		return nil, err
+	}
+
+	p.metadata = metadata.New(md)
+
+	return p, nil
+}
+
+// client returns the connection to the endpoint, creating it on first use.
+func (p *grpcPulse) client() (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, errGRPCClosed
+	}
+
+	if p.conn == nil {
+		params := grpc.ConnectParams{Backoff: backoff.DefaultConfig}
+		params.Backoff.MaxDelay = grpcMaxBackoff
+
+		conn, err := grpc.NewClient(p.endpoint, p.dialOpt, grpc.WithConnectParams(params))
+		if err != nil {
+			return nil, err
+		}
+
+		p.conn = conn
+	}
+
+	return p.conn, nil
+}
+
+// Close closes the connection to the endpoint.
+func (p *grpcPulse) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+
+	if p.conn == nil {
+		return nil
+	}
+
+	return p.conn.Close()
+}
+
+func (p *grpcPulse) Check(ctx context.Context) Result {
+	conn, err := p.client()
+	if err != nil {
+		return failure(ReasonConnection, "unable to connect to %s: %s", p.endpoint, err)
+	}
+
+	r, err := healthpb.NewHealthClient(conn).Check(
+		metadata.NewOutgoingContext(ctx, p.metadata),
+		&healthpb.HealthCheckRequest{Service: p.service})
+
+	if err != nil {
+		return failure(ReasonConnection, "error while checking health of %s: %s", p.endpoint, err)
+	} else if r.Status != healthpb.HealthCheckResponse_SERVING {
+		return failure(ReasonResponse, "service %q at %s is %s", p.service, p.endpoint, r.Status)
+	}
+
+	return Result{Status: StatusUp}
+}
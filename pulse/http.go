@@ -21,31 +21,66 @@
 package pulse
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kobolog/gorb/util"
-
-	log "github.com/Sirupsen/logrus"
 )
 
 var (
-	errRedirects = errors.New("redirects are not supported for pulse requests")
+	errRedirects     = errors.New("redirects are not supported for pulse requests")
+	errInvalidExpect = errors.New("expected status codes must be numbers or ranges")
+	errInvalidHeader = errors.New("header values must be strings")
 )
 
+// Only this much of the response body is examined by the body assertions.
+const maxBodyLength = 64 * 1024
+
+// codeRange is an inclusive range of accepted HTTP status codes.
+type codeRange struct {
+	lo, hi int
+}
+
 type httpPulse struct {
 	Driver
 
 	client http.Client
-	httpRq *http.Request
-	expect int
+	method string
+	target string
+	expect []codeRange
+
+	// Optional request payload and headers.
+	rqBody    string
+	rqHeaders map[string]string
+
+	// Optional response assertions.
+	body    string
+	bodyRe  *regexp.Regexp
+	headers map[string]*regexp.Regexp
+
+	// Certificate expiry warning window, HTTPS only.
+	window time.Duration
 }
 
 func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
-	c := http.Client{Timeout: 5 * time.Second, CheckRedirect: func(
+	return newHTTPDriver("http", host, port, opts)
+}
+
+func newHTTPSDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	return newHTTPDriver("https", host, port, opts)
+}
+
+func newHTTPDriver(scheme, host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	c := http.Client{CheckRedirect: func(
 		req *http.Request,
 		via []*http.Request,
 	) error {
@@ -53,33 +88,250 @@ func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error
 	}}
 
 	pulseHost := opts.Get("host", host).(string)
-	pulsePort := opts.Get("port", int(port)).(int)
+
+	pulsePort, err := portArg(opts, "port", port)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &httpPulse{
+		method: opts.Get("method", "GET").(string),
+		rqBody: opts.Get("request_body", "").(string),
+		body:   opts.Get("body", "").(string),
+	}
+
+	if scheme == "https" {
+		tlsConfig, err := newTLSConfig(pulseHost, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep-alives are disabled to verify the certificate on every check.
+		c.Transport = &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		}
+
+		if p.window, err = util.ParseInterval(
+			opts.Get("expiry_warning", "168h").(string)); err != nil {
+			return nil, err
+		}
+	}
 
 	u := url.URL{
-		Scheme: "http",
+		Scheme: scheme,
 		Host:   fmt.Sprintf("%s:%d", pulseHost, pulsePort),
 		Path:   opts.Get("path", "/").(string)}
 
-	r, err := http.NewRequest(opts.Get("method", "GET").(string), u.String(), nil)
+	p.client, p.target = c, u.String()
+
+	expect, exists := opts["expect"]
+	if !exists {
+		expect = http.StatusOK
+	}
+
+	if p.expect, err = parseStatusCodes(expect); err != nil {
+		return nil, err
+	}
+
+	if re := opts.Get("body_regex", "").(string); len(re) != 0 {
+		if p.bodyRe, err = regexp.Compile(re); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.rqHeaders, err = parseHeaders(opts["request_headers"]); err != nil {
+		return nil, err
+	}
+
+	headers, err := parseHeaders(opts["headers"])
 	if err != nil {
 		return nil, err
 	}
 
-	return &httpPulse{
-		client: c,
-		httpRq: r,
-		expect: opts.Get("expect", 200).(int),
-	}, nil
+	p.headers = make(map[string]*regexp.Regexp, len(headers))
+
+	for name, value := range headers {
+		if p.headers[name], err = regexp.Compile(value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure the request can actually be built.
+	if _, err := p.newRequest(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
 
-func (p *httpPulse) Check() StatusType {
-	if r, err := p.client.Do(p.httpRq); err != nil {
-		log.Errorf("error while communicating with %s: %s", p.httpRq.URL, err)
-	} else if r.StatusCode != p.expect {
-		log.Errorf("received non-%d status code from %s", p.expect, p.httpRq.URL)
-	} else {
-		return StatusUp
+// newRequest builds a new request for every check, since the body can
+// only be consumed once.
+func (p *httpPulse) newRequest() (*http.Request, error) {
+	var body io.Reader
+
+	if len(p.rqBody) != 0 {
+		body = strings.NewReader(p.rqBody)
+	}
+
+	r, err := http.NewRequest(p.method, p.target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range p.rqHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			r.Host = value
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+
+	return r, nil
+}
+
+func (p *httpPulse) Check(ctx context.Context) Result {
+	rq, err := p.newRequest()
+	if err != nil {
+		return failure(ReasonError, "error while building request for %s: %s", p.target, err)
+	}
+
+	r, err := p.client.Do(rq.WithContext(ctx))
+	if err != nil {
+		return failure(ReasonConnection, "error while communicating with %s: %s", p.target, err)
+	}
+
+	defer r.Body.Close()
+
+	expiring, err := checkExpiry(r.TLS, p.window)
+	if err != nil {
+		// Possible when the certificate verification is disabled.
+		return failure(ReasonResponse, "invalid certificate at %s: %s", p.target, err)
+	} else if err := p.verify(r); err != nil {
+		return failure(ReasonResponse, "unexpected response from %s: %s", p.target, err)
+	}
+
+	if expiring {
+		return Result{Status: StatusUp, Message: fmt.Sprintf(
+			"certificate at %s expires in less than %s", p.target, p.window)}
+	}
+
+	return Result{Status: StatusUp}
+}
+
+// verify matches the response against configured assertions.
+func (p *httpPulse) verify(r *http.Response) error {
+	accepted := false
+
+	for _, c := range p.expect {
+		if r.StatusCode >= c.lo && r.StatusCode <= c.hi {
+			accepted = true
+			break
+		}
+	}
+
+	if !accepted {
+		return fmt.Errorf("status code %d is not accepted", r.StatusCode)
+	}
+
+	for name, re := range p.headers {
+		if values, exists := r.Header[http.CanonicalHeaderKey(name)]; !exists {
+			return fmt.Errorf("header %s is missing", name)
+		} else if !re.MatchString(strings.Join(values, ", ")) {
+			return fmt.Errorf("header %s doesn't match %q", name, re)
+		}
+	}
+
+	if len(p.body) == 0 && p.bodyRe == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodyLength))
+	if err != nil {
+		return err
+	}
+
+	if len(p.body) != 0 && !strings.Contains(string(body), p.body) {
+		return fmt.Errorf("body doesn't contain %q", p.body)
+	}
+
+	if p.bodyRe != nil && !p.bodyRe.Match(body) {
+		return fmt.Errorf("body doesn't match %q", p.bodyRe)
+	}
+
+	return nil
+}
+
+// parseStatusCodes accepts a single status code, a "lo-hi" range, a comma
+// separated list of those or a JSON array of any of the above.
+func parseStatusCodes(v interface{}) ([]codeRange, error) {
+	switch v := v.(type) {
+	case int:
+		return []codeRange{{v, v}}, nil
+	case float64:
+		return []codeRange{{int(v), int(v)}}, nil
+	case string:
+		var r []codeRange
+
+		for _, item := range strings.Split(v, ",") {
+			bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+
+			lo, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errInvalidExpect
+			}
+
+			hi := lo
+
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil || hi < lo {
+					return nil, errInvalidExpect
+				}
+			}
+
+			r = append(r, codeRange{lo, hi})
+		}
+
+		return r, nil
+	case []interface{}:
+		var r []codeRange
+
+		for _, item := range v {
+			codes, err := parseStatusCodes(item)
+			if err != nil {
+				return nil, err
+			}
+
+			r = append(r, codes...)
+		}
+
+		return r, nil
+	}
+
+	return nil, errInvalidExpect
+}
+
+// parseHeaders converts a JSON object into a header map.
+func parseHeaders(v interface{}) (map[string]string, error) {
+	r := make(map[string]string)
+
+	switch v := v.(type) {
+	case nil:
+	case map[string]string:
+		for name, value := range v {
+			r[name] = value
+		}
+	case map[string]interface{}:
+		for name, value := range v {
+			if s, ok := value.(string); ok {
+				r[name] = s
+			} else {
+				return nil, errInvalidHeader
+			}
+		}
+	default:
+		return nil, errInvalidHeader
 	}
 
-	return StatusDown
+	return r, nil
 }
@@ -30,33 +30,76 @@ type Metrics struct {
 	Health float64       `json:"health"`
 	Uptime time.Duration `json:"uptime"`
 
+	// Consecutive check results, compared against rise & fall thresholds.
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+
+	// Number of status transitions and the time of the last one.
+	Transitions int       `json:"transitions"`
+	LastChange  time.Time `json:"last_change"`
+
+	// Current effective interval between checks, including back-offs.
+	Interval string `json:"interval"`
+
+	// Details on the last check: why it has failed, if it did, and how
+	// long it took. Penalty is the fraction of backend's weight withheld
+	// on the driver's request.
+	Reason  string        `json:"reason,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Penalty float64       `json:"penalty"`
+	Latency time.Duration `json:"latency"`
+
+	// Metrics of individual checks for composite pulses.
+	Checks []Metrics `json:"checks,omitempty"`
+
 	// Historical information for statistics calculation.
 	lastTs time.Time
-	record []StatusType
+	score  scorer
+
+	// Thresholds for status transitions.
+	rise int
+	fall int
 }
 
 // NewMetrics creates a new instance of metrics.
 func NewMetrics() *Metrics {
-	return &Metrics{Status: StatusUp, Health: 1, Uptime: 0, lastTs: time.Now()}
+	ts := time.Now()
+
+	return &Metrics{Status: StatusUp, Health: 1, Uptime: 0, LastChange: ts,
+		lastTs: ts, score: &windowScorer{size: 100}, rise: 1, fall: 1}
 }
 
 // Update updates metrics based on Pulse status message.
 func (m *Metrics) Update(status StatusType) Metrics {
-	m.Status = status
-	m.Health = 0
-	m.record = append(m.record, status)
+	switch status {
+	case StatusUp:
+		m.Successes, m.Failures = m.Successes+1, 0
+	case StatusDown:
+		m.Successes, m.Failures = 0, m.Failures+1
+	}
 
-	if len(m.record) > 100 {
-		m.record = m.record[1:]
+	// Status flips only when the corresponding threshold is reached.
+	next := m.Status
+
+	switch {
+	case status == StatusUp && m.Successes >= m.rise:
+		next = StatusUp
+	case status == StatusDown && m.Failures >= m.fall:
+		next = StatusDown
+	case status == StatusRemoved:
+		next = StatusRemoved
 	}
 
-	for _, result := range m.record {
-		m.Health += float64(result)
+	if next != m.Status {
+		m.Transitions, m.LastChange = m.Transitions+1, time.Now()
 	}
 
-	m.Health = 1.0 - m.Health/float64(len(m.record))
+	ts := time.Now()
+
+	m.Status = next
+	m.Health = m.score.Add(status, ts)
 
-	if ts := time.Now(); m.Status != StatusUp {
+	if m.Status != StatusUp {
 		m.Uptime, m.lastTs = 0, ts
 	} else {
 		m.Uptime, m.lastTs = m.Uptime+ts.Sub(m.lastTs)/time.Second, ts
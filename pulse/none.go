@@ -21,6 +21,8 @@
 package pulse
 
 import (
+	"context"
+
 	"github.com/kobolog/gorb/util"
 )
 
@@ -32,6 +34,6 @@ func newNoopDriver(host string, port uint16, opts util.DynamicMap) (Driver, erro
 	return &constantDriver{StatusUp}, nil
 }
 
-func (p *constantDriver) Check() StatusType {
-	return p.status
+func (p *constantDriver) Check(ctx context.Context) Result {
+	return Result{Status: p.status}
 }
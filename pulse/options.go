@@ -22,6 +22,9 @@ package pulse
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,20 +35,81 @@ import (
 var (
 	ErrUnknownPulseType     = errors.New("specified pulse type is unknown")
 	ErrInvalidPulseInterval = errors.New("pulse interval must be positive")
+	ErrInvalidPulseTimeout  = errors.New("pulse timeout must be positive")
+	ErrInvalidThreshold     = errors.New("rise and fall thresholds must be positive")
+	ErrUnknownBackoff       = errors.New("specified back-off policy is unknown")
+	ErrInvalidMaxInterval   = errors.New("max pulse interval must not be less than interval")
+	ErrInvalidChecks        = errors.New("composite checks cannot be nested or empty")
+	ErrInvalidPolicy        = errors.New("policy must be all, any or a number of checks")
+	ErrUnknownScore         = errors.New("specified health score algorithm is unknown")
+	ErrInvalidScoreWindow   = errors.New("health score window must be positive")
 )
 
+// Possible back-off policies for failing backends.
+const (
+	BackoffNone        = "none"
+	BackoffExponential = "exponential"
+)
+
+// Possible aggregation policies for composite checks.
+const (
+	PolicyAll = "all"
+	PolicyAny = "any"
+)
+
+// Possible health score algorithms.
+const (
+	ScoreWindow = "window"
+	ScoreTime   = "time"
+	ScoreEWMA   = "ewma"
+)
+
+// TypeComposite is the pulse type of composite checks.
+const TypeComposite = "composite"
+
 // Options contain Pulse configuration.
 type Options struct {
 	Type     string          `json:"type"`
 	Interval string          `json:"interval"`
+	Timeout  string          `json:"timeout"`
 	Args     util.DynamicMap `json:"args"`
 
-	interval time.Duration
+	// Number of consecutive successful or failed checks required to
+	// flip the backend status to Up or Down, respectively.
+	Rise int `json:"rise"`
+	Fall int `json:"fall"`
+
+	// Back-off policy for backends which are Down, the interval between
+	// checks grows up to MaxInterval while the backend keeps failing.
+	Backoff     string `json:"backoff"`
+	MaxInterval string `json:"max_interval"`
+
+	// Composite checks, each with its own driver and interval. Backend is
+	// considered Up if all, any or a given number of them pass.
+	Checks []*Options `json:"checks,omitempty"`
+	Policy string     `json:"policy,omitempty"`
+
+	// Health score algorithm: share of successful checks among the last
+	// Window ones or within the last Period, or their exponentially
+	// weighted moving average with the given HalfLife.
+	Score    string `json:"score"`
+	Window   int    `json:"window,omitempty"`
+	Period   string `json:"period,omitempty"`
+	HalfLife string `json:"half_life,omitempty"`
+
+	interval    time.Duration
+	timeout     time.Duration
+	maxInterval time.Duration
+	quorum      int
+	period      time.Duration
+	halfLife    time.Duration
 }
 
 // Validate fills missing fields and validates Pulse configuration.
 func (o *Options) Validate() error {
-	if len(o.Type) == 0 {
+	if len(o.Type) == 0 && len(o.Checks) != 0 {
+		o.Type = TypeComposite
+	} else if len(o.Type) == 0 {
 		// TCP is a safe guess: the majority of services are TCP-based.
 		o.Type = "tcp"
 	}
@@ -54,19 +118,231 @@ func (o *Options) Validate() error {
 		o.Interval = "1m"
 	}
 
+	if len(o.Timeout) == 0 {
+		o.Timeout = "5s"
+	}
+
 	o.Type = strings.ToLower(o.Type)
 
-	if fn := get[o.Type]; fn == nil {
+	var err error
+
+	if o.Type == TypeComposite {
+		if err = o.validateChecks(); err != nil {
+			return err
+		}
+	} else if fn := lookupDriver(o.Type); fn == nil {
 		return ErrUnknownPulseType
+	} else if len(o.Checks) != 0 {
+		return ErrInvalidChecks
 	}
 
-	var err error
-
 	if o.interval, err = util.ParseInterval(o.Interval); err != nil {
 		return err
 	} else if o.interval <= 0 {
 		return ErrInvalidPulseInterval
 	}
 
+	if o.timeout, err = util.ParseInterval(o.Timeout); err != nil {
+		return err
+	} else if o.timeout <= 0 {
+		return ErrInvalidPulseTimeout
+	}
+
+	if o.Rise == 0 {
+		o.Rise = 1
+	}
+
+	if o.Fall == 0 {
+		o.Fall = 1
+	}
+
+	if o.Rise < 0 || o.Fall < 0 {
+		return ErrInvalidThreshold
+	}
+
+	if len(o.Backoff) == 0 {
+		o.Backoff = BackoffNone
+	}
+
+	o.Backoff = strings.ToLower(o.Backoff)
+
+	switch o.Backoff {
+	case BackoffNone, BackoffExponential:
+	default:
+		return ErrUnknownBackoff
+	}
+
+	if len(o.MaxInterval) == 0 {
+		// Seems like a sane default: dead backends are checked 10x less often.
+		o.MaxInterval = fmt.Sprintf("%ds", int64(10*o.interval/time.Second))
+	}
+
+	if o.maxInterval, err = util.ParseInterval(o.MaxInterval); err != nil {
+		return err
+	} else if o.maxInterval < o.interval {
+		return ErrInvalidMaxInterval
+	}
+
+	return o.validateScore()
+}
+
+func (o *Options) validateScore() error {
+	if len(o.Score) == 0 {
+		o.Score = ScoreWindow
+	}
+
+	o.Score = strings.ToLower(o.Score)
+
+	var err error
+
+	switch o.Score {
+	case ScoreWindow:
+		if o.Window == 0 {
+			o.Window = 100
+		} else if o.Window < 0 {
+			return ErrInvalidScoreWindow
+		}
+	case ScoreTime:
+		if len(o.Period) == 0 {
+			o.Period = "10m"
+		}
+
+		if o.period, err = util.ParseInterval(o.Period); err != nil {
+			return err
+		} else if o.period <= 0 {
+			return ErrInvalidScoreWindow
+		}
+	case ScoreEWMA:
+		if len(o.HalfLife) == 0 {
+			o.HalfLife = "1m"
+		}
+
+		if o.halfLife, err = util.ParseInterval(o.HalfLife); err != nil {
+			return err
+		} else if o.halfLife <= 0 {
+			return ErrInvalidScoreWindow
+		}
+	default:
+		return ErrUnknownScore
+	}
+
+	return nil
+}
+
+func (o *Options) validateChecks() error {
+	if len(o.Checks) == 0 {
+		return ErrInvalidChecks
+	}
+
+	for _, check := range o.Checks {
+		if check == nil || check.Type == TypeComposite || len(check.Checks) != 0 {
+			return ErrInvalidChecks
+		}
+
+		if err := check.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(o.Policy) == 0 {
+		o.Policy = PolicyAll
+	}
+
+	o.Policy = strings.ToLower(o.Policy)
+
+	switch o.Policy {
+	case PolicyAll:
+		o.quorum = len(o.Checks)
+	case PolicyAny:
+		o.quorum = 1
+	default:
+		n, err := strconv.Atoi(o.Policy)
+		if err != nil || n < 1 || n > len(o.Checks) {
+			return ErrInvalidPolicy
+		}
+
+		o.quorum = n
+	}
+
 	return nil
 }
+
+// boolArg returns the boolean pulse argument or the default value if it's
+// not set.
+func boolArg(args util.DynamicMap, key string, d bool) (bool, error) {
+	v, exists := args[key]
+
+	if !exists {
+		return d, nil
+	}
+
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+
+	return false, fmt.Errorf("pulse argument %s must be a boolean", key)
+}
+
+// intArg returns the integer pulse argument or the default value if it's
+// not set. Numbers decoded from JSON are float64, so whole ones are accepted
+// as well as strings of digits.
+func intArg(args util.DynamicMap, key string, d int) (int, error) {
+	v, exists := args[key]
+
+	if !exists {
+		return d, nil
+	}
+
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int(n), nil
+		}
+	case string:
+		if i, err := strconv.Atoi(n); err == nil {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pulse argument %s must be an integer", key)
+}
+
+// portArg returns the port pulse argument or the default port if it's not
+// set.
+func portArg(args util.DynamicMap, key string, d uint16) (uint16, error) {
+	n, err := intArg(args, key, int(d))
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 || n > math.MaxUint16 {
+		return 0, fmt.Errorf("pulse argument %s must be a port number", key)
+	}
+
+	return uint16(n), nil
+}
+
+// floatArg returns the numeric pulse argument or the default value if it's
+// not set.
+func floatArg(args util.DynamicMap, key string, d float64) (float64, error) {
+	v, exists := args[key]
+
+	if !exists {
+		return d, nil
+	}
+
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case string:
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return f, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pulse argument %s must be a number", key)
+}
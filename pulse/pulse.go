@@ -21,36 +21,105 @@
 package pulse
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"os"
+	"sync"
 	"time"
 
-	"github.com/kobolog/gorb/util"
-
 	log "github.com/Sirupsen/logrus"
 )
 
-// Driver provides the actual health check for Pulse.
+// Driver provides the actual health check for Pulse. Drivers must respect
+// the context deadline and cancellation. Drivers implementing io.Closer are
+// closed once the Pulse is stopped.
 type Driver interface {
-	Check() StatusType
+	Check(ctx context.Context) Result
 }
 
-var (
-	get = map[string]func(string, uint16, util.DynamicMap) (Driver, error){
-		"tcp":  newTCPDriver,
-		"http": newGETDriver,
-		"none": newNoopDriver,
+// Possible reasons of failed checks.
+const (
+	ReasonTimeout    = "timeout"
+	ReasonConnection = "connection"
+	ReasonResponse   = "response"
+	ReasonError      = "error"
+)
+
+// Result is the outcome of a single health check.
+type Result struct {
+	Status StatusType
+
+	// Why the check has failed, one of the reasons above, and the
+	// human-readable details.
+	Reason  string
+	Message string
+
+	// Fraction of backend's weight which should be withheld while it's up.
+	Penalty float64
+
+	// Time it took to run the check.
+	Latency time.Duration
+}
+
+// failure returns a failed check result. Timeout errors among the arguments
+// override the reason, as sockets with the check deadline may fail before
+// the context does.
+func failure(reason, format string, args ...interface{}) Result {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok && isTimeout(err) {
+			reason = ReasonTimeout
+		}
 	}
 
+	return Result{Status: StatusDown, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// isTimeout returns whether the error is caused by an expired deadline.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+var (
 	// Use a separate random device to avoid fucking with other packages.
-	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// Unlike the global one, it's not safe for concurrent use on its own.
+	rng      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	rngMutex sync.Mutex
 )
 
 // Pulse is an health check manager for a backend.
 type Pulse struct {
 	driver   Driver
 	interval time.Duration
+	backoff  string
+	maxIntvl time.Duration
+	timeout  time.Duration
 	stopCh   chan struct{}
 	metrics  *Metrics
+
+	// Cancels in-flight checks when the Pulse is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Composite checks and how many of them have to pass.
+	checks []*Pulse
+	quorum int
+
+	// Latest metrics of composite checks, which might report concurrently.
+	mutex   sync.Mutex
+	results []Metrics
+
+	// Set once the Pulse is run by a Scheduler instead of Loop.
+	scheduler *Scheduler
 }
 
 // New creates a new Pulse from the provided endpoint and options.
@@ -59,14 +128,52 @@ func New(host string, port uint16, opts *Options) (*Pulse, error) {
 		return nil, err
 	}
 
-	d, err := get[opts.Type](host, port, opts.Args)
-	if err != nil {
+	var (
+		d      Driver
+		checks []*Pulse
+		err    error
+	)
+
+	if opts.Type == TypeComposite {
+		for _, check := range opts.Checks {
+			p, err := New(host, port, check)
+			if err != nil {
+				return nil, err
+			}
+
+			checks = append(checks, p)
+		}
+	} else if d, err = lookupDriver(opts.Type)(host, port, opts.Args); err != nil {
 		return nil, err
 	}
 
 	stopCh := make(chan struct{})
 
-	return &Pulse{d, opts.interval, stopCh, NewMetrics()}, nil
+	m := NewMetrics()
+	m.rise, m.fall, m.score = opts.Rise, opts.Fall, newScorer(opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &Pulse{driver: d, interval: opts.interval, backoff: opts.Backoff,
+		maxIntvl: opts.maxInterval, timeout: opts.timeout, stopCh: stopCh, metrics: m,
+		ctx: ctx, cancel: cancel, checks: checks, quorum: opts.quorum}
+
+	for _, check := range checks {
+		p.results = append(p.results, *check.metrics)
+	}
+
+	return p, nil
+}
+
+// close releases the resources held by the drivers, such as connections.
+func (p *Pulse) close() {
+	if c, ok := p.driver.(io.Closer); ok {
+		c.Close()
+	}
+
+	for _, check := range p.checks {
+		check.close()
+	}
 }
 
 // Update is a Pulse notification message.
@@ -79,32 +186,221 @@ type Update struct {
 func (p *Pulse) Loop(id ID, pulseCh chan Update, consumerStopCh <-chan struct{}) {
 	log.Infof("starting pulse for %s", id)
 
-	// Randomize the first health-check to avoid thundering herd syndrome.
-	interval := time.Duration(rng.Int63n(int64(p.interval)))
+	if len(p.checks) != 0 {
+		p.loopComposite(id, pulseCh, consumerStopCh)
+		return
+	}
+
+	interval := p.jitter()
 
 	for {
 		select {
 		case <-time.After(interval):
-			select {
 			// Recalculate metrics and statistics and send them to Context.
-			case pulseCh <- Update{id, p.metrics.Update(p.driver.Check())}:
+			interval = p.tick(id)
+
+			select {
+			case pulseCh <- Update{id, *p.metrics}:
 			case <-consumerStopCh:
 				// prevent blocking if the consumer stops before us
 			}
 		case <-p.stopCh:
 			log.Infof("stopping pulse for %s", id)
-			pulseCh <- Update{id, p.metrics.Update(StatusRemoved)}
+			pulseCh <- Update{id, p.remove()}
 			return
 		}
 
-		// TODO(@kobolog): Add exponential back-offs, thresholds.
-		interval = p.interval
-
 		log.Debugf("current pulse for %s: %s", id, p.metrics.Status.String())
 	}
 }
 
+// tick runs a single check and returns the interval until the next one.
+func (p *Pulse) tick(id ID) time.Duration {
+	ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+
+	ts := time.Now()
+	r := p.driver.Check(ctx)
+	r.Latency = time.Since(ts)
+
+	if r.Status != StatusUp {
+		if deadline, _ := ctx.Deadline(); ctx.Err() == context.DeadlineExceeded || !time.Now().Before(deadline) {
+			r.Reason = ReasonTimeout
+		} else if len(r.Reason) == 0 {
+			r.Reason = ReasonError
+		}
+
+		log.Errorf("pulse check for %s has failed: %s", id, r.Message)
+	} else {
+		r.Reason = ""
+	}
+
+	p.metrics.Update(r.Status)
+	p.metrics.Reason, p.metrics.Message = r.Reason, r.Message
+	p.metrics.Penalty, p.metrics.Latency = r.Penalty, r.Latency
+
+	interval := p.nextInterval()
+	p.metrics.Interval = interval.String()
+
+	return interval
+}
+
+// loopComposite runs every check on its own schedule and aggregates their
+// results into the backend status each time one of them reports.
+func (p *Pulse) loopComposite(id ID, pulseCh chan Update, consumerStopCh <-chan struct{}) {
+	checkCh := make(chan Metrics)
+
+	for i, check := range p.checks {
+		interval := check.jitter()
+
+		go func(i int, check *Pulse, interval time.Duration) {
+			for {
+				select {
+				case <-time.After(interval):
+					interval = check.tick(id)
+
+					select {
+					case checkCh <- p.report(i, *check.metrics):
+					case <-p.stopCh:
+						return
+					}
+				case <-p.stopCh:
+					return
+				}
+			}
+		}(i, check, interval)
+	}
+
+	for {
+		select {
+		case m := <-checkCh:
+			// Aggregated metrics are updated by the check goroutines under
+			// the mutex, so log the copy made by report() instead.
+			log.Debugf("current pulse for %s: %s", id, m.Status.String())
+
+			select {
+			case pulseCh <- Update{id, m}:
+			case <-consumerStopCh:
+				// prevent blocking if the consumer stops before us
+			}
+		case <-p.stopCh:
+			log.Infof("stopping pulse for %s", id)
+			pulseCh <- Update{id, p.remove()}
+			return
+		}
+	}
+}
+
+// report records metrics of the given composite check and returns the
+// aggregated metrics of the backend.
+func (p *Pulse) report(index int, m Metrics) Metrics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.results[index] = m
+
+	p.metrics.Update(p.aggregate(p.results))
+	p.metrics.Checks = append([]Metrics(nil), p.results...)
+
+	return *p.metrics
+}
+
+// remove marks the backend as removed and returns its final metrics.
+func (p *Pulse) remove() Metrics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.metrics.Update(StatusRemoved)
+}
+
+// jitter returns a random delay before the first check.
+func (p *Pulse) jitter() time.Duration {
+	rngMutex.Lock()
+	defer rngMutex.Unlock()
+
+	// Randomize the first health-check to avoid thundering herd syndrome.
+	return time.Duration(rng.Int63n(int64(p.interval)))
+}
+
+// stopped returns whether the Pulse has been stopped.
+func (p *Pulse) stopped() bool {
+	select {
+	case <-p.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// aggregate returns Up if enough checks pass, the largest penalty of all
+// checks is applied to the backend and the slowest check sets the latency.
+func (p *Pulse) aggregate(results []Metrics) StatusType {
+	var (
+		passed int
+		reason string
+	)
+
+	p.metrics.Penalty, p.metrics.Latency = 0, 0
+
+	for _, m := range results {
+		if m.Status == StatusUp {
+			passed++
+		} else if len(reason) == 0 {
+			reason = m.Reason
+		}
+
+		if m.Penalty > p.metrics.Penalty {
+			p.metrics.Penalty = m.Penalty
+		}
+
+		if m.Latency > p.metrics.Latency {
+			p.metrics.Latency = m.Latency
+		}
+	}
+
+	if passed < p.quorum {
+		p.metrics.Reason = reason
+		return StatusDown
+	}
+
+	p.metrics.Reason = ""
+
+	return StatusUp
+}
+
+// nextInterval returns the interval until the next check, backing off
+// exponentially for each failed check after the backend went Down.
+func (p *Pulse) nextInterval() time.Duration {
+	if p.backoff != BackoffExponential || p.metrics.Status != StatusDown {
+		return p.interval
+	}
+
+	interval := p.interval
+
+	for n := p.metrics.Failures - p.metrics.fall; n > 0 && interval < p.maxIntvl; n-- {
+		interval *= 2
+	}
+
+	if interval > p.maxIntvl {
+		interval = p.maxIntvl
+	}
+
+	return interval
+}
+
 // Stop stops the Pulse.
 func (p *Pulse) Stop() {
+	for _, check := range p.checks {
+		check.cancel()
+	}
+
+	p.cancel()
+	p.close()
+
+	if p.scheduler != nil {
+		p.scheduler.remove(p)
+		return
+	}
+
 	close(p.stopCh)
 }
@@ -21,15 +21,29 @@
 package pulse
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/kobolog/gorb/util"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func TestGenericOptions(t *testing.T) {
@@ -66,6 +80,7 @@ func TestGenericOptions(t *testing.T) {
 		assert.Equal(t, test.rv.Interval, test.in.Interval)
 		assert.Equal(t, test.rv.Args, test.in.Args)
 		assert.Equal(t, test.rv.interval, test.in.interval)
+		assert.Equal(t, 5*time.Second, test.in.timeout)
 	}
 
 	// Invalid type.
@@ -88,6 +103,34 @@ func TestGenericOptions(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, ErrInvalidPulseInterval, err)
 
+	// Non-positive timeout.
+	opts = &Options{Type: "tcp", Timeout: "0s"}
+	err = opts.Validate()
+
+	require.Error(t, err)
+	assert.Equal(t, ErrInvalidPulseTimeout, err)
+
+	// Negative thresholds.
+	opts = &Options{Type: "tcp", Fall: -1}
+	err = opts.Validate()
+
+	require.Error(t, err)
+	assert.Equal(t, ErrInvalidThreshold, err)
+
+	// Invalid back-off policy.
+	opts = &Options{Type: "tcp", Backoff: "linear"}
+	err = opts.Validate()
+
+	require.Error(t, err)
+	assert.Equal(t, ErrUnknownBackoff, err)
+
+	// Max interval less than interval.
+	opts = &Options{Type: "tcp", Interval: "5m", MaxInterval: "1m"}
+	err = opts.Validate()
+
+	require.Error(t, err)
+	assert.Equal(t, ErrInvalidMaxInterval, err)
+
 	// pulse.New() validating options.
 	_, err = New("host", 80, &Options{Type: "unknown-driver"})
 
@@ -103,7 +146,7 @@ func TestMetrics(t *testing.T) {
 		m.Update(StatusUp)
 	}
 
-	assert.Equal(t, 100, len(m.record))
+	assert.Equal(t, 100, len(m.score.(*windowScorer).record))
 
 	// Uptime switch.
 	m.Update(StatusDown)
@@ -111,6 +154,151 @@ func TestMetrics(t *testing.T) {
 	assert.Equal(t, time.Duration(0), m.Uptime)
 }
 
+func TestMetricsThresholds(t *testing.T) {
+	m := NewMetrics()
+	m.rise, m.fall = 2, 3
+
+	// Two failures are not enough to flip the status.
+	m.Update(StatusDown)
+	m.Update(StatusDown)
+
+	assert.Equal(t, StatusUp, m.Status)
+	assert.Equal(t, 2, m.Failures)
+	assert.Equal(t, 0, m.Transitions)
+
+	m.Update(StatusDown)
+
+	assert.Equal(t, StatusDown, m.Status)
+	assert.Equal(t, 1, m.Transitions)
+
+	// One success is not enough to bring it back.
+	m.Update(StatusUp)
+
+	assert.Equal(t, StatusDown, m.Status)
+	assert.Equal(t, 1, m.Successes)
+	assert.Equal(t, 0, m.Failures)
+
+	m.Update(StatusUp)
+
+	assert.Equal(t, StatusUp, m.Status)
+	assert.Equal(t, 2, m.Transitions)
+}
+
+func TestScoreOptions(t *testing.T) {
+	opts := &Options{}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, ScoreWindow, opts.Score)
+	assert.Equal(t, 100, opts.Window)
+
+	opts = &Options{Score: "EWMA"}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, ScoreEWMA, opts.Score)
+	assert.Equal(t, "1m", opts.HalfLife)
+	assert.Equal(t, time.Minute, opts.halfLife)
+
+	opts = &Options{Score: "time"}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, "10m", opts.Period)
+	assert.Equal(t, 10*time.Minute, opts.period)
+
+	for _, test := range []struct {
+		opts *Options
+		err  error
+	}{
+		{&Options{Score: "unknown"}, ErrUnknownScore},
+		{&Options{Window: -1}, ErrInvalidScoreWindow},
+		{&Options{Score: "time", Period: "-5s"}, ErrInvalidScoreWindow},
+		{&Options{Score: "ewma", HalfLife: "-5s"}, ErrInvalidScoreWindow},
+	} {
+		assert.Equal(t, test.err, test.opts.Validate())
+	}
+}
+
+// recoveryTime returns how long it takes for the health to get back to 1
+// after a long outage, checking the backend every interval.
+func recoveryTime(t *testing.T, opts *Options, interval time.Duration) time.Duration {
+	require.NoError(t, opts.Validate())
+
+	var (
+		s  = newScorer(opts)
+		ts = time.Now()
+	)
+
+	for i := 0; i < 1000; i++ {
+		ts = ts.Add(interval)
+		require.Equal(t, 0.0, s.Add(StatusDown, ts))
+	}
+
+	for i := 1; i <= 1000; i++ {
+		if s.Add(StatusUp, ts.Add(time.Duration(i)*interval)) == 1 {
+			return time.Duration(i) * interval
+		}
+	}
+
+	t.Fatal("health has never recovered")
+
+	return 0
+}
+
+func TestScoreRecovery(t *testing.T) {
+	tests := []struct {
+		opts     *Options
+		interval time.Duration
+		rv       time.Duration
+	}{
+		// Default window: slow recovery for long intervals.
+		{&Options{}, time.Minute, 100 * time.Minute},
+		{&Options{}, 10 * time.Second, 1000 * time.Second},
+		{&Options{Window: 10}, time.Minute, 10 * time.Minute},
+
+		// Time window: recovery takes the same time regardless of interval.
+		{&Options{Score: "time", Period: "5m"}, time.Minute, 5 * time.Minute},
+		{&Options{Score: "time", Period: "5m"}, 10 * time.Second, 5 * time.Minute},
+
+		// EWMA: recovers in ~6.64 half-lives, rounded up to the interval.
+		{&Options{Score: "ewma", HalfLife: "1m"}, time.Minute, 7 * time.Minute},
+		{&Options{Score: "ewma", HalfLife: "1m"}, 10 * time.Second, 400 * time.Second},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.rv, recoveryTime(t, test.opts, test.interval), "%+v", test.opts)
+	}
+
+	// EWMA health grows gradually: half of it is restored after a half-life.
+	s := newScorer(&Options{Score: "ewma", halfLife: time.Minute})
+	ts := time.Now()
+
+	s.Add(StatusDown, ts)
+	assert.InDelta(t, 0.5, s.Add(StatusUp, ts.Add(time.Minute)), 1e-9)
+}
+
+func TestPulseBackoff(t *testing.T) {
+	bp, err := New("", 0, &Options{Type: "none", Interval: "1s", Fall: 2,
+		Backoff: "exponential", MaxInterval: "5s"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		status StatusType
+		rv     time.Duration
+	}{
+		{StatusDown, 1 * time.Second},
+		{StatusDown, 1 * time.Second},
+		{StatusDown, 2 * time.Second},
+		{StatusDown, 4 * time.Second},
+		{StatusDown, 5 * time.Second},
+		{StatusDown, 5 * time.Second},
+		{StatusUp, 1 * time.Second},
+	}
+
+	for _, test := range tests {
+		bp.metrics.Update(test.status)
+		assert.Equal(t, test.rv, bp.nextInterval())
+	}
+}
+
 func TestPulseChannel(t *testing.T) {
 	var (
 		pulseCh = make(chan Update)
@@ -139,6 +327,76 @@ func TestPulseChannel(t *testing.T) {
 	assert.Zero(t, update.Metrics.Uptime)
 }
 
+func TestCompositeOptions(t *testing.T) {
+	opts := &Options{Checks: []*Options{{Type: "none"}, {Type: "tcp"}}}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, TypeComposite, opts.Type)
+	assert.Equal(t, PolicyAll, opts.Policy)
+	assert.Equal(t, 2, opts.quorum)
+	assert.Equal(t, "1m", opts.Checks[1].Interval)
+
+	tests := []struct {
+		in  *Options
+		err error
+	}{
+		{&Options{Type: "composite"}, ErrInvalidChecks},
+		{&Options{Type: "tcp", Checks: []*Options{{Type: "none"}}}, ErrInvalidChecks},
+		{&Options{Checks: []*Options{{Checks: []*Options{{Type: "none"}}}}}, ErrInvalidChecks},
+		{&Options{Checks: []*Options{{Type: "invalid"}}}, ErrUnknownPulseType},
+		{&Options{Checks: []*Options{{Type: "none"}}, Policy: "2"}, ErrInvalidPolicy},
+		{&Options{Checks: []*Options{{Type: "none"}}, Policy: "most"}, ErrInvalidPolicy},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.err, test.in.Validate())
+	}
+}
+
+func TestCompositePulse(t *testing.T) {
+	failing := &Options{Type: "exec", Interval: "1s", Args: util.DynamicMap{
+		"command": []interface{}{"sh", "-c", "echo failed; exit 2"}}}
+
+	tests := []struct {
+		policy string
+		rv     StatusType
+	}{
+		{"all", StatusDown},
+		{"any", StatusUp},
+		{"1", StatusUp},
+		{"2", StatusDown},
+	}
+
+	for _, test := range tests {
+		var (
+			pulseCh = make(chan Update)
+			id      = ID{"VsID", "rsID"}
+		)
+
+		bp, err := New("localhost", 80, &Options{Policy: test.policy, Checks: []*Options{
+			{Type: "none", Interval: "1s"}, failing}})
+		require.NoError(t, err)
+
+		go bp.Loop(id, pulseCh, make(chan struct{}))
+
+		var update Update
+
+		// Wait until both checks report.
+		for update = <-pulseCh; update.Metrics.Checks[0].Successes == 0 ||
+			update.Metrics.Checks[1].Failures == 0; update = <-pulseCh {
+		}
+
+		assert.Equal(t, test.rv, update.Metrics.Status)
+		assert.Equal(t, "failed", update.Metrics.Checks[1].Message)
+
+		bp.Stop()
+
+		// Drain until the status remove update.
+		for update = <-pulseCh; update.Metrics.Status != StatusRemoved; update = <-pulseCh {
+		}
+	}
+}
+
 func TestPulseStop(t *testing.T) {
 	var (
 		pulseCh = make(chan Update)
@@ -168,11 +426,73 @@ func TestPulseStop(t *testing.T) {
 	assert.Equal(t, StatusRemoved, update.Metrics.Status)
 }
 
+func TestFailureReason(t *testing.T) {
+	// Sockets with the check deadline fail with timeout errors.
+	assert.Equal(t, ReasonTimeout, failure(ReasonConnection, "%s", os.ErrDeadlineExceeded).Reason)
+	assert.Equal(t, ReasonTimeout, failure(ReasonResponse, "%s",
+		&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}).Reason)
+	assert.Equal(t, ReasonTimeout, failure(ReasonResponse, "%s",
+		fmt.Errorf("exchange failed: %w", context.DeadlineExceeded)).Reason)
+
+	assert.Equal(t, ReasonConnection, failure(ReasonConnection, "%s", io.EOF).Reason)
+	assert.Equal(t, ReasonResponse, failure(ReasonResponse, "unexpected %d", 42).Reason)
+}
+
+func TestPulseTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	// Accept connections, but never reply.
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	bp, err := New("localhost", uint16(ln.Addr().(*net.TCPAddr).Port), &Options{
+		Type:    "tcp",
+		Timeout: "1s",
+		Args: util.DynamicMap{"steps": []interface{}{
+			map[string]interface{}{"expect": "+OK"}}}})
+	require.NoError(t, err)
+
+	bp.tick(ID{"VsID", "rsID"})
+
+	assert.Equal(t, StatusDown, bp.metrics.Status)
+	assert.Equal(t, ReasonTimeout, bp.metrics.Reason)
+	assert.NotEmpty(t, bp.metrics.Message)
+	assert.True(t, bp.metrics.Latency >= time.Second)
+	assert.True(t, bp.metrics.Latency < 2*time.Second)
+}
+
+func TestDriverRegistry(t *testing.T) {
+	RegisterDriver("Custom", func(host string, port uint16, args util.DynamicMap) (Driver, error) {
+		return &constantDriver{status: StatusDown}, nil
+	})
+	defer unregisterDriver("Custom")
+
+	assert.Contains(t, Drivers(), "custom")
+	assert.Contains(t, Drivers(), "tcp")
+
+	bp, err := New("localhost", 80, &Options{Type: "CUSTOM"})
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusDown, bp.driver.Check(context.Background()).Status)
+
+	assert.Panics(t, func() { RegisterDriver("tcp", newTCPDriver) })
+	assert.Panics(t, func() { RegisterDriver("composite", newTCPDriver) })
+	assert.Panics(t, func() { RegisterDriver("other", nil) })
+}
+
 func TestNopDriver(t *testing.T) {
 	bp, err := New("", 0, &Options{Type: "none"})
 	require.NoError(t, err)
 
-	assert.Equal(t, StatusUp, bp.driver.Check())
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
 }
 
 func TestTCPDriver(t *testing.T) {
@@ -196,13 +516,95 @@ func TestTCPDriver(t *testing.T) {
 	require.NoError(t, err)
 
 	// Normal connection attempt.
-	assert.Equal(t, StatusUp, bp.driver.Check())
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
 
 	// Wait for the listener to be closed.
 	wg.Wait()
 
 	// Connection failure.
-	assert.Equal(t, StatusDown, bp.driver.Check())
+	assert.Equal(t, StatusDown, bp.driver.Check(context.Background()).Status)
+}
+
+func TestTCPDriverConversation(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(cn net.Conn) {
+				defer cn.Close()
+
+				cn.Write([]byte("220 ready\r\n"))
+
+				buf := make([]byte, 64)
+				switch n, _ := cn.Read(buf); string(buf[:n]) {
+				case "PING\r\n":
+					cn.Write([]byte("+PO"))
+					cn.Write([]byte("NG\r\n"))
+				case "MULTI\r\n":
+					// Both replies arrive in a single segment.
+					cn.Write([]byte("+OK\r\n+PONG\r\n"))
+				}
+
+				// Hang until the client gives up.
+				cn.Read(buf)
+			}(cn)
+		}
+	}()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		steps []interface{}
+		rv    StatusType
+	}{
+		{[]interface{}{
+			map[string]interface{}{"expect_regex": "^220 "},
+			map[string]interface{}{"send": "PING\r\n"},
+			map[string]interface{}{"expect": "+PONG"},
+		}, StatusUp},
+		{[]interface{}{
+			map[string]interface{}{"expect": "220"},
+			map[string]interface{}{"send_hex": "50 49 4e 47 0d 0a"},
+			map[string]interface{}{"expect_hex": "2b504f4e47"},
+		}, StatusUp},
+		{[]interface{}{
+			map[string]interface{}{"send": "MULTI\r\n"},
+			map[string]interface{}{"expect": "+OK\r\n"},
+			map[string]interface{}{"expect_regex": "^\\+PONG"},
+		}, StatusUp},
+		{[]interface{}{
+			map[string]interface{}{"send": "PING\r\n"},
+			map[string]interface{}{"expect": "+PONG"},
+			// Listening, but never replies.
+			map[string]interface{}{"expect": "+PONG"},
+		}, StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "tcp",
+			Args: util.DynamicMap{"steps": test.steps, "read_timeout": "1s"}})
+		require.NoError(t, err)
+
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+	}
+
+	// Invalid steps.
+	for _, steps := range []interface{}{
+		"PING",
+		[]interface{}{map[string]interface{}{"receive": "PONG"}},
+		[]interface{}{map[string]interface{}{"send": "PING", "expect": "PONG"}},
+		[]interface{}{map[string]interface{}{"send_hex": "zz"}},
+	} {
+		_, err := New("localhost", 80, &Options{Type: "tcp", Args: util.DynamicMap{"steps": steps}})
+		require.Error(t, err)
+	}
 }
 
 func TestGETDriver(t *testing.T) {
@@ -243,7 +645,99 @@ func TestGETDriver(t *testing.T) {
 		bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "http"})
 		require.NoError(t, err)
 
-		assert.Equal(t, test.rv, bp.driver.Check())
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+	}
+}
+
+func TestGETDriverAssertions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "app.example.com" || r.Header.Get("X-Token") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"status":"` + string(body) + `"}`))
+		}))
+	defer ts.Close()
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+	rqArgs := util.DynamicMap{
+		"method":          "POST",
+		"request_body":    "ok",
+		"request_headers": map[string]interface{}{"Host": "app.example.com", "X-Token": "secret"},
+	}
+
+	tests := []struct {
+		args util.DynamicMap
+		rv   StatusType
+	}{
+		{util.DynamicMap{}, StatusDown},
+		{util.DynamicMap{"expect": "200-299"}, StatusUp},
+		{util.DynamicMap{"expect": []interface{}{200.0, "202"}}, StatusUp},
+		{util.DynamicMap{"expect": "200,204"}, StatusDown},
+		{util.DynamicMap{"expect": 202, "body": `"status":"ok"`}, StatusUp},
+		{util.DynamicMap{"expect": 202, "body": "degraded"}, StatusDown},
+		{util.DynamicMap{"expect": 202, "body_regex": `"status":\s*"(ok|fine)"`}, StatusUp},
+		{util.DynamicMap{"expect": 202, "headers": map[string]interface{}{"content-type": "json"}}, StatusUp},
+		{util.DynamicMap{"expect": 202, "headers": map[string]interface{}{"X-Missing": ""}}, StatusDown},
+	}
+
+	for _, test := range tests {
+		for k, v := range rqArgs {
+			test.args[k] = v
+		}
+
+		bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "http", Args: test.args})
+		require.NoError(t, err)
+
+		// Body has to be sent on every check, not just the first one.
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+	}
+
+	// Invalid assertions.
+	for _, args := range []util.DynamicMap{
+		{"expect": "2xx"},
+		{"expect": "299-200"},
+		{"body_regex": "("},
+		{"headers": "Content-Type"},
+	} {
+		_, err := New("localhost", 80, &Options{Type: "http", Args: args})
+		require.Error(t, err)
+	}
+}
+
+func TestGETDriverPort(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer ts.Close()
+
+	tcpPort := ts.Listener.Addr().(*net.TCPAddr).Port
+
+	// Options decoded from a JSON request body.
+	var opts Options
+
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(
+		`{"type": "http", "args": {"port": %d}}`, tcpPort)), &opts))
+
+	bp, err := New("localhost", 80, &opts)
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
+
+	for _, port := range []string{`"http"`, "0", "65536", "80.5"} {
+		opts = Options{}
+		require.NoError(t, json.Unmarshal([]byte(
+			`{"type": "http", "args": {"port": `+port+`}}`), &opts))
+
+		_, err = New("localhost", 80, &opts)
+		require.Error(t, err)
 	}
 }
 
@@ -257,5 +751,408 @@ func TestGETDriverNoConnection(t *testing.T) {
 	require.NoError(t, err)
 
 	// Connection failure.
-	assert.Equal(t, StatusDown, bp.driver.Check())
+	assert.Equal(t, StatusDown, bp.driver.Check(context.Background()).Status)
+}
+
+func TestHTTPSDriver(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer ts.Close()
+
+	ca, err := ioutil.TempFile("", "gorb-ca")
+	require.NoError(t, err)
+	defer os.Remove(ca.Name())
+
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	ca.Close()
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		args util.DynamicMap
+		rv   StatusType
+	}{
+		// Unknown certificate authority.
+		{util.DynamicMap{}, StatusDown},
+		// Verification disabled.
+		{util.DynamicMap{"insecure": true}, StatusUp},
+		// Custom CA bundle, test certificate is issued for "example.com".
+		{util.DynamicMap{"ca": ca.Name(), "server_name": "example.com"}, StatusUp},
+		// Custom CA bundle, but server name mismatch.
+		{util.DynamicMap{"ca": ca.Name(), "server_name": "example.org"}, StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", uint16(tcpAddr.Port), &Options{Type: "https", Args: test.args})
+		require.NoError(t, err)
+
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+	}
+
+	// Invalid TLS configurations.
+	_, err = New("127.0.0.1", 443, &Options{Type: "https", Args: util.DynamicMap{"ca": "/nonexistent"}})
+	require.Error(t, err)
+
+	_, err = New("127.0.0.1", 443, &Options{Type: "https", Args: util.DynamicMap{"cert": ca.Name()}})
+	require.Error(t, err)
+
+	_, err = New("127.0.0.1", 443, &Options{Type: "https", Args: util.DynamicMap{"insecure": 1.0}})
+	require.Error(t, err)
+}
+
+func TestGRPCDriver(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	hs := health.NewServer()
+	hs.SetServingStatus("app", healthpb.HealthCheckResponse_SERVING)
+
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+
+	go gs.Serve(ln)
+	defer gs.Stop()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+
+	newPulse := func(args util.DynamicMap) *Pulse {
+		bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "grpc", Args: args})
+		require.NoError(t, err)
+		t.Cleanup(bp.Stop)
+		return bp
+	}
+
+	// Overall server health and a specific service.
+	assert.Equal(t, StatusUp, newPulse(util.DynamicMap{}).driver.Check(context.Background()).Status)
+	assert.Equal(t, StatusUp, newPulse(util.DynamicMap{
+		"service":  "app",
+		"metadata": map[string]interface{}{"x-token": "secret"},
+	}).driver.Check(context.Background()).Status)
+
+	// Unknown service.
+	assert.Equal(t, StatusDown, newPulse(util.DynamicMap{"service": "unknown"}).driver.Check(context.Background()).Status)
+
+	// Service is not serving.
+	hs.SetServingStatus("app", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, StatusDown, newPulse(util.DynamicMap{"service": "app"}).driver.Check(context.Background()).Status)
+
+	// Plain-text server, TLS client.
+	assert.Equal(t, StatusDown, newPulse(util.DynamicMap{"tls": true}).driver.Check(context.Background()).Status)
+
+	// Port overridden with a number decoded from JSON.
+	assert.Equal(t, StatusUp, newPulse(util.DynamicMap{"port": float64(tcpAddr.Port)}).driver.Check(
+		context.Background()).Status)
+
+	// Connection is reused between checks and closed once the pulse is stopped.
+	bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "grpc"})
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
+	conn := bp.driver.(*grpcPulse).conn
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
+	assert.True(t, conn == bp.driver.(*grpcPulse).conn)
+
+	bp.Stop()
+	assert.Equal(t, connectivity.Shutdown, conn.GetState())
+	assert.Equal(t, StatusDown, bp.driver.Check(context.Background()).Status)
+
+	// Invalid arguments.
+	for _, args := range []util.DynamicMap{{"port": 1.5}, {"port": 70000.0}, {"port": true}, {"tls": "yes"}} {
+		_, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "grpc", Args: args})
+		assert.Error(t, err)
+	}
+}
+
+func dnsReply(t *testing.T, query []byte) []byte {
+	var m dnsmessage.Message
+	require.NoError(t, m.Unpack(query))
+
+	m.Response = true
+
+	if m.Questions[0].Name.String() == "example.com." {
+		m.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		}}
+	} else {
+		m.RCode = dnsmessage.RCodeNameError
+	}
+
+	r, err := m.Pack()
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestDNSDriver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsReply(t, buf[:n]), addr)
+		}
+	}()
+
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+
+	tests := []struct {
+		args util.DynamicMap
+		rv   StatusType
+	}{
+		{util.DynamicMap{"name": "example.com", "type": "a"}, StatusUp},
+		{util.DynamicMap{"name": "example.com", "answer": "^10\\.0\\.0\\.1$"}, StatusUp},
+		{util.DynamicMap{"name": "example.com", "answer": "^10\\.0\\.0\\.2$"}, StatusDown},
+		{util.DynamicMap{"name": "example.org"}, StatusDown},
+		{util.DynamicMap{"name": "example.org", "rcode": "nxdomain"}, StatusUp},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", uint16(udpAddr.Port), &Options{Type: "dns", Args: test.args})
+		require.NoError(t, err)
+
+		assert.Equal(t, test.rv, bp.driver.Check(context.Background()).Status)
+	}
+
+	// Invalid options.
+	for _, args := range []util.DynamicMap{
+		{"type": "XYZ"},
+		{"rcode": "WHATEVER"},
+		{"protocol": "sctp"},
+		{"answer": "("},
+	} {
+		_, err := New("127.0.0.1", 53, &Options{Type: "dns", Args: args})
+		require.Error(t, err)
+	}
+}
+
+func TestDNSDriverTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		cn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer cn.Close()
+
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(cn, buf[:2]); err != nil {
+			return
+		}
+
+		n := int(buf[0])<<8 | int(buf[1])
+		if _, err := io.ReadFull(cn, buf[:n]); err != nil {
+			return
+		}
+
+		r := dnsReply(t, buf[:n])
+		cn.Write(append([]byte{byte(len(r) >> 8), byte(len(r))}, r...))
+	}()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	bp, err := New("127.0.0.1", uint16(tcpAddr.Port), &Options{Type: "dns",
+		Args: util.DynamicMap{"name": "example.com", "type": "A", "protocol": "tcp"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
+}
+
+func TestExecDriver(t *testing.T) {
+	tests := []struct {
+		args    util.DynamicMap
+		rv      StatusType
+		message string
+		penalty float64
+	}{
+		{
+			util.DynamicMap{"command": []interface{}{"sh", "-c", "echo OK - $GORB_HOST:$GORB_PORT {port}"}},
+			StatusUp, "OK - localhost:8080 8080", 0,
+		},
+		{
+			util.DynamicMap{"command": []interface{}{"sh", "-c", "echo WARNING; exit 1"}, "warning_penalty": 0.5},
+			StatusUp, "WARNING", 0.5,
+		},
+		{
+			util.DynamicMap{"command": []interface{}{"sh", "-c", "echo CRITICAL; exit 2"}},
+			StatusDown, "CRITICAL", 0,
+		},
+		{
+			// Numbers are float64 when decoded from JSON.
+			util.DynamicMap{"command": []interface{}{"sh", "-c", "echo DEGRADED; exit 3"},
+				"warning_code": 3.0, "warning_penalty": 0.25},
+			StatusUp, "DEGRADED", 0.25,
+		},
+		{
+			util.DynamicMap{"command": []interface{}{"sleep", "5"}},
+			StatusDown, "command sleep failed: context deadline exceeded", 0,
+		},
+		{
+			util.DynamicMap{"command": "/nonexistent"},
+			StatusDown, "", 0,
+		},
+	}
+
+	for _, test := range tests {
+		bp, err := New("localhost", 8080, &Options{Type: "exec", Timeout: "1s", Args: test.args})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), bp.timeout)
+		r := bp.driver.Check(ctx)
+		cancel()
+
+		assert.Equal(t, test.rv, r.Status)
+
+		if len(test.message) != 0 {
+			assert.Equal(t, test.message, r.Message)
+		}
+
+		assert.Equal(t, test.penalty, r.Penalty)
+	}
+
+	// Forked processes holding the output open are killed on timeout too.
+	bp, err := New("localhost", 8080, &Options{Type: "exec", Args: util.DynamicMap{
+		"command": []interface{}{"sh", "-c", "sleep 5 & sleep 5"}}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	r := bp.driver.Check(ctx)
+
+	assert.Equal(t, StatusDown, r.Status)
+	assert.Equal(t, ReasonTimeout, r.Reason)
+	assert.True(t, time.Since(start) < execWaitDelay, "check outlived its timeout")
+
+	// Invalid options.
+	for _, args := range []util.DynamicMap{
+		{},
+		{"command": []interface{}{}},
+		{"command": []interface{}{"check", 42}},
+		{"command": "check", "warning_penalty": 1.5},
+		{"command": "check", "warning_penalty": "lots"},
+		{"command": "check", "warning_code": 2.5},
+		{"command": "check", "warning_code": true},
+	} {
+		_, err := New("localhost", 8080, &Options{Type: "exec", Args: args})
+		require.Error(t, err)
+	}
+}
+
+func TestParseAgentReply(t *testing.T) {
+	tests := []struct {
+		in      string
+		status  StatusType
+		penalty float64
+	}{
+		{"up", StatusUp, 0},
+		{"ready 75%", StatusUp, 0.25},
+		{"75%,up", StatusUp, 0.25},
+		{"150%", StatusUp, 0},
+		{"drain", StatusUp, 1},
+		{"drain 50%", StatusUp, 1},
+		{"maint", StatusDown, 0},
+		{"down #overloaded", StatusDown, 0},
+	}
+
+	for _, test := range tests {
+		status, penalty, err := parseAgentReply(test.in)
+		require.NoError(t, err)
+
+		assert.Equal(t, test.status, status, test.in)
+		assert.Equal(t, test.penalty, penalty, test.in)
+	}
+
+	for _, in := range []string{"", "hello", "-5%", "abc%"} {
+		_, _, err := parseAgentReply(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestAgentDriver(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			buf := make([]byte, 16)
+			n, _ := cn.Read(buf)
+
+			if string(buf[:n]) == "status\n" {
+				cn.Write([]byte("up 40%\n"))
+			} else {
+				cn.Write([]byte("maint\n"))
+			}
+
+			cn.Close()
+		}
+	}()
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("drain"))
+		}))
+	defer ts.Close()
+
+	tcpPort := ln.Addr().(*net.TCPAddr).Port
+	httpPort := ts.Listener.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		args    util.DynamicMap
+		rv      StatusType
+		message string
+		penalty float64
+	}{
+		{util.DynamicMap{"port": tcpPort, "send": "status\n"}, StatusUp, "up 40%", 0.6},
+		{util.DynamicMap{"port": tcpPort, "send": "other\n"}, StatusDown, "maint", 0},
+		{util.DynamicMap{"port": httpPort, "protocol": "http"}, StatusUp, "drain", 1},
+	}
+
+	for _, test := range tests {
+		bp, err := New("localhost", 80, &Options{Type: "agent", Args: test.args})
+		require.NoError(t, err)
+
+		r := bp.driver.Check(context.Background())
+
+		assert.Equal(t, test.rv, r.Status)
+		assert.Equal(t, test.message, r.Message)
+		assert.InDelta(t, test.penalty, r.Penalty, 1e-9)
+	}
+
+	// Options decoded from a JSON request body.
+	var opts Options
+
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(
+		`{"type": "agent", "args": {"port": %d, "send": "status\n"}}`, tcpPort)), &opts))
+
+	bp, err := New("localhost", 80, &opts)
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check(context.Background()).Status)
+
+	opts = Options{}
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "agent", "args": {"port": "agent"}}`), &opts))
+
+	_, err = New("localhost", 80, &opts)
+	require.Error(t, err)
+
+	_, err = New("localhost", 80, &Options{Type: "agent", Args: util.DynamicMap{"protocol": "udp"}})
+	require.Error(t, err)
 }
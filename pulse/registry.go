@@ -0,0 +1,99 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kobolog/gorb/util"
+)
+
+// DriverFactory creates a Driver for the backend's host and port from the
+// pulse arguments.
+type DriverFactory func(host string, port uint16, args util.DynamicMap) (Driver, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]DriverFactory{
+		"tcp":   newTCPDriver,
+		"http":  newGETDriver,
+		"https": newHTTPSDriver,
+		"grpc":  newGRPCDriver,
+		"dns":   newDNSDriver,
+		"exec":  newExecDriver,
+		"agent": newAgentDriver,
+		"none":  newNoopDriver,
+	}
+)
+
+// RegisterDriver makes a pulse driver available under the given name, which
+// is case-insensitive. It's meant to be called from init functions, so it
+// panics if the name is empty or already taken.
+func RegisterDriver(name string, factory DriverFactory) {
+	name = strings.ToLower(name)
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if len(name) == 0 || name == TypeComposite || factory == nil {
+		panic(fmt.Sprintf("pulse: invalid driver registration for %q", name))
+	}
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("pulse: driver %q is already registered", name))
+	}
+
+	registry[name] = factory
+}
+
+// unregisterDriver removes a driver registered with RegisterDriver.
+func unregisterDriver(name string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	delete(registry, strings.ToLower(name))
+}
+
+// Drivers returns a sorted list of registered driver names.
+func Drivers() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	r := make([]string, 0, len(registry))
+
+	for name := range registry {
+		r = append(r, name)
+	}
+
+	sort.Strings(r)
+
+	return r
+}
+
+func lookupDriver(name string) DriverFactory {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	return registry[name]
+}
@@ -0,0 +1,345 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SchedulerOptions configure the Scheduler.
+type SchedulerOptions struct {
+	// Number of checks running concurrently.
+	Workers int
+
+	// Maximum number of checks started per second, unlimited if zero.
+	Rate float64
+
+	// Updates are sent in batches as soon as BatchSize of them accumulate
+	// or every FlushInterval, whichever comes first.
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// Scheduler runs checks of many Pulses on a bounded pool of workers and
+// sends their updates in batches, instead of a goroutine per Pulse.
+type Scheduler struct {
+	opts SchedulerOptions
+
+	mutex   sync.Mutex
+	queue   schedule
+	entries map[*Pulse][]*entry
+	wakeCh  chan struct{}
+	workCh  chan *entry
+
+	batchMutex sync.Mutex
+	batch      []Update
+	flushCh    chan struct{}
+	updateCh   chan<- []Update
+
+	stopCh chan struct{}
+}
+
+// entry is a single scheduled check. Checks of composite Pulses are
+// scheduled independently and report to their parent.
+type entry struct {
+	id     ID
+	pulse  *Pulse
+	parent *Pulse
+	index  int
+	next   time.Time
+
+	// Position in the schedule, or -1 while the check is running.
+	position int
+}
+
+// schedule is a min-heap of entries ordered by their next check time.
+type schedule []*entry
+
+func (s schedule) Len() int           { return len(s) }
+func (s schedule) Less(i, j int) bool { return s[i].next.Before(s[j].next) }
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].position, s[j].position = i, j
+}
+
+func (s *schedule) Push(x interface{}) {
+	e := x.(*entry)
+	e.position = len(*s)
+	*s = append(*s, e)
+}
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	e := old[len(old)-1]
+	e.position = -1
+	*s = old[:len(old)-1]
+	return e
+}
+
+// NewScheduler creates a new Scheduler, sending update batches to updateCh.
+func NewScheduler(opts SchedulerOptions, updateCh chan<- []Update) *Scheduler {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 100 * time.Millisecond
+	}
+
+	s := &Scheduler{
+		opts:     opts,
+		entries:  make(map[*Pulse][]*entry),
+		wakeCh:   make(chan struct{}, 1),
+		workCh:   make(chan *entry),
+		flushCh:  make(chan struct{}, 1),
+		updateCh: updateCh,
+		stopCh:   make(chan struct{}),
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		go s.work()
+	}
+
+	go s.dispatch()
+	go s.flush()
+
+	return s
+}
+
+// Add schedules checks of the Pulse. Stopping the Pulse removes its checks
+// from the Scheduler and sends the final update.
+func (s *Scheduler) Add(id ID, p *Pulse) {
+	log.Infof("scheduling pulse for %s", id)
+
+	var entries []*entry
+
+	if len(p.checks) == 0 {
+		entries = append(entries, &entry{id: id, pulse: p, next: time.Now().Add(p.jitter())})
+	}
+
+	for i, check := range p.checks {
+		entries = append(entries, &entry{
+			id: id, pulse: check, parent: p, index: i, next: time.Now().Add(check.jitter())})
+	}
+
+	s.mutex.Lock()
+	p.scheduler = s
+	s.entries[p] = entries
+
+	for _, e := range entries {
+		heap.Push(&s.queue, e)
+	}
+
+	s.mutex.Unlock()
+	s.wake()
+}
+
+// Stop stops the Scheduler. Checks in progress are not waited for.
+func (s *Scheduler) Stop() {
+	close(s.stopCh)
+}
+
+// remove stops the Pulse and drops its pending checks. The final update is
+// sent right away, and checks still running won't report after it.
+func (s *Scheduler) remove(p *Pulse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	close(p.stopCh)
+
+	entries, exists := s.entries[p]
+
+	if !exists {
+		return
+	}
+
+	for _, e := range entries {
+		if e.position >= 0 {
+			heap.Remove(&s.queue, e.position)
+		}
+	}
+
+	delete(s.entries, p)
+
+	log.Infof("stopping pulse for %s", entries[0].id)
+	s.emit(Update{entries[0].id, p.remove()})
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands due checks over to workers, respecting the rate limit.
+func (s *Scheduler) dispatch() {
+	var next time.Time
+
+	for {
+		s.mutex.Lock()
+
+		var (
+			e    *entry
+			wait = time.Hour
+		)
+
+		if len(s.queue) != 0 {
+			if wait = time.Until(s.queue[0].next); wait <= 0 {
+				e = heap.Pop(&s.queue).(*entry)
+			}
+		}
+
+		s.mutex.Unlock()
+
+		if e == nil {
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-timer.C:
+			case <-s.wakeCh:
+				timer.Stop()
+			case <-s.stopCh:
+				timer.Stop()
+				return
+			}
+
+			continue
+		}
+
+		if s.opts.Rate > 0 {
+			if now := time.Now(); next.Before(now) {
+				next = now
+			}
+
+			select {
+			case <-time.After(time.Until(next)):
+			case <-s.stopCh:
+				return
+			}
+
+			next = next.Add(time.Duration(float64(time.Second) / s.opts.Rate))
+		}
+
+		select {
+		case s.workCh <- e:
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) work() {
+	for {
+		select {
+		case e := <-s.workCh:
+			s.run(e)
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) run(e *entry) {
+	owner := e.pulse
+
+	if e.parent != nil {
+		owner = e.parent
+	}
+
+	if owner.stopped() {
+		return
+	}
+
+	interval := e.pulse.tick(e.id)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The Pulse might have been stopped during the check, in which case its
+	// final update has already been sent.
+	if owner.stopped() {
+		return
+	}
+
+	if e.parent != nil {
+		s.emit(Update{e.id, e.parent.report(e.index, *e.pulse.metrics)})
+	} else {
+		s.emit(Update{e.id, *e.pulse.metrics})
+	}
+
+	e.next = time.Now().Add(interval)
+	heap.Push(&s.queue, e)
+	s.wake()
+}
+
+func (s *Scheduler) emit(u Update) {
+	s.batchMutex.Lock()
+	s.batch = append(s.batch, u)
+	full := len(s.batch) >= s.opts.BatchSize
+	s.batchMutex.Unlock()
+
+	if full {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush sends accumulated updates to the consumer.
+func (s *Scheduler) flush() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushCh:
+		case <-s.stopCh:
+			return
+		}
+
+		s.batchMutex.Lock()
+		batch := s.batch
+		s.batch = nil
+		s.batchMutex.Unlock()
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		select {
+		case s.updateCh <- batch:
+		case <-s.stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler(t *testing.T) {
+	var (
+		updateCh = make(chan []Update)
+		ids      = []ID{{"VsID", "rs1"}, {"VsID", "rs2"}, {"VsID", "rs3"}}
+		pulses   []*Pulse
+	)
+
+	s := NewScheduler(SchedulerOptions{Workers: 2, BatchSize: len(ids),
+		FlushInterval: time.Minute}, updateCh)
+	defer s.Stop()
+
+	for _, id := range ids {
+		bp, err := New("", 0, &Options{Type: "none", Interval: "1s"})
+		require.NoError(t, err)
+
+		s.Add(id, bp)
+		pulses = append(pulses, bp)
+	}
+
+	// All first checks are due within the interval and fill up the batch.
+	batch := <-updateCh
+
+	require.Len(t, batch, len(ids))
+
+	for _, update := range batch {
+		assert.Contains(t, ids, update.Source)
+		assert.Equal(t, StatusUp, update.Metrics.Status)
+	}
+
+	for _, bp := range pulses {
+		bp.Stop()
+	}
+
+	removed := map[ID]bool{}
+
+	for len(removed) != len(ids) {
+		for _, update := range <-updateCh {
+			if update.Metrics.Status == StatusRemoved {
+				removed[update.Source] = true
+			}
+		}
+	}
+}
+
+func TestSchedulerComposite(t *testing.T) {
+	var (
+		updateCh = make(chan []Update)
+		id       = ID{"VsID", "rsID"}
+	)
+
+	s := NewScheduler(SchedulerOptions{Workers: 2, BatchSize: 1}, updateCh)
+	defer s.Stop()
+
+	bp, err := New("localhost", 80, &Options{Policy: "any", Checks: []*Options{
+		{Type: "none", Interval: "1s"}, {Type: "none", Interval: "1s"}}})
+	require.NoError(t, err)
+
+	s.Add(id, bp)
+
+	var update Update
+
+	// Wait until both checks report.
+	for update = (<-updateCh)[0]; update.Metrics.Checks[0].Successes == 0 ||
+		update.Metrics.Checks[1].Successes == 0; update = (<-updateCh)[0] {
+	}
+
+	assert.Equal(t, id, update.Source)
+	assert.Equal(t, StatusUp, update.Metrics.Status)
+
+	bp.Stop()
+
+	// Only one removal is reported for all the checks.
+	for update = (<-updateCh)[0]; update.Metrics.Status != StatusRemoved; update = (<-updateCh)[0] {
+	}
+
+	select {
+	case batch := <-updateCh:
+		t.Errorf("unexpected updates after removal: %v", batch)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	var (
+		updateCh = make(chan []Update)
+		id       = ID{"VsID", "RsID"}
+	)
+
+	s := NewScheduler(SchedulerOptions{FlushInterval: 10 * time.Millisecond}, updateCh)
+	defer s.Stop()
+
+	bp, err := New("", 0, &Options{Type: "none", Interval: "1h"})
+	require.NoError(t, err)
+
+	s.Add(id, bp)
+	bp.Stop()
+
+	// The removal doesn't wait for the next check to come due.
+	select {
+	case batch := <-updateCh:
+		require.Len(t, batch, 1)
+		assert.Equal(t, id, batch[0].Source)
+		assert.Equal(t, StatusRemoved, batch[0].Metrics.Status)
+	case <-time.After(time.Second):
+		t.Fatal("no removal reported")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	assert.Empty(t, s.queue)
+	assert.Empty(t, s.entries)
+}
+
+func TestSchedulerRate(t *testing.T) {
+	updateCh := make(chan []Update)
+
+	s := NewScheduler(SchedulerOptions{Workers: 10, Rate: 10, BatchSize: 100,
+		FlushInterval: 100 * time.Millisecond}, updateCh)
+	defer s.Stop()
+
+	for i := 0; i < 100; i++ {
+		bp, err := New("", 0, &Options{Type: "none", Interval: "1s"})
+		require.NoError(t, err)
+
+		s.Add(ID{"VsID", fmt.Sprintf("rs%d", i)}, bp)
+	}
+
+	var (
+		deadline = time.After(time.Second)
+		checks   int
+	)
+
+	for {
+		select {
+		case batch := <-updateCh:
+			checks += len(batch)
+			continue
+		case <-deadline:
+		}
+
+		break
+	}
+
+	// About 10 checks per second are allowed, regardless of their intervals.
+	assert.True(t, checks > 0 && checks <= 12, "%d checks in a second", checks)
+}
+
+const benchmarkBackends = 10000
+
+func benchmarkPulses(b *testing.B) []*Pulse {
+	pulses := make([]*Pulse, benchmarkBackends)
+
+	for i := range pulses {
+		bp, err := New("", 0, &Options{Type: "none", Interval: "1s"})
+		require.NoError(b, err)
+
+		pulses[i] = bp
+	}
+
+	return pulses
+}
+
+// BenchmarkScheduler measures the time per check with 10k backends
+// checked every second on the worker pool.
+func BenchmarkScheduler(b *testing.B) {
+	var (
+		updateCh = make(chan []Update)
+		pulses   = benchmarkPulses(b)
+	)
+
+	s := NewScheduler(SchedulerOptions{Workers: 64}, updateCh)
+	defer s.Stop()
+
+	b.ResetTimer()
+
+	for i, bp := range pulses {
+		s.Add(ID{"VsID", fmt.Sprintf("rs%d", i)}, bp)
+	}
+
+	for checks := 0; checks < b.N; {
+		checks += len(<-updateCh)
+	}
+}
+
+// BenchmarkLoop is the same as BenchmarkScheduler with a goroutine per
+// backend.
+func BenchmarkLoop(b *testing.B) {
+	var (
+		pulseCh = make(chan Update)
+		stopCh  = make(chan struct{})
+		pulses  = benchmarkPulses(b)
+	)
+
+	defer close(stopCh)
+
+	b.ResetTimer()
+
+	for i, bp := range pulses {
+		go bp.Loop(ID{"VsID", fmt.Sprintf("rs%d", i)}, pulseCh, stopCh)
+	}
+
+	for checks := 0; checks < b.N; checks++ {
+		<-pulseCh
+	}
+
+	b.StopTimer()
+
+	for _, bp := range pulses {
+		bp.Stop()
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"math"
+	"time"
+)
+
+// scorer calculates backend's health from the history of check results.
+type scorer interface {
+	Add(status StatusType, ts time.Time) float64
+}
+
+func newScorer(opts *Options) scorer {
+	switch opts.Score {
+	case ScoreTime:
+		return &timeScorer{period: opts.period}
+	case ScoreEWMA:
+		return &ewmaScorer{halfLife: opts.halfLife}
+	default:
+		return &windowScorer{size: opts.Window}
+	}
+}
+
+// windowScorer is the share of successful checks among the last few.
+type windowScorer struct {
+	size   int
+	record []StatusType
+}
+
+func (s *windowScorer) Add(status StatusType, ts time.Time) float64 {
+	s.record = append(s.record, status)
+
+	if len(s.record) > s.size {
+		s.record = s.record[len(s.record)-s.size:]
+	}
+
+	passed := 0
+
+	for _, result := range s.record {
+		if result == StatusUp {
+			passed++
+		}
+	}
+
+	return float64(passed) / float64(len(s.record))
+}
+
+type sample struct {
+	status StatusType
+	ts     time.Time
+}
+
+// timeScorer is the share of successful checks within the last period,
+// so that the recovery time doesn't depend on the check interval.
+type timeScorer struct {
+	period time.Duration
+	record []sample
+}
+
+func (s *timeScorer) Add(status StatusType, ts time.Time) float64 {
+	s.record = append(s.record, sample{status, ts})
+
+	// The latest sample is always kept, regardless of its age.
+	for len(s.record) > 1 && ts.Sub(s.record[0].ts) >= s.period {
+		s.record = s.record[1:]
+	}
+
+	passed := 0
+
+	for _, result := range s.record {
+		if result.status == StatusUp {
+			passed++
+		}
+	}
+
+	return float64(passed) / float64(len(s.record))
+}
+
+// Exponentially weighted health within this distance from 1 is considered
+// fully recovered, otherwise it would never get there.
+const ewmaEpsilon = 0.01
+
+// ewmaScorer is an exponentially weighted moving average of check results,
+// where the weight of each result halves every half-life.
+type ewmaScorer struct {
+	halfLife time.Duration
+	value    float64
+	lastTs   time.Time
+}
+
+func (s *ewmaScorer) Add(status StatusType, ts time.Time) float64 {
+	var x float64
+
+	if status == StatusUp {
+		x = 1
+	}
+
+	if s.lastTs.IsZero() {
+		s.value = x
+	} else {
+		decay := math.Exp2(-float64(ts.Sub(s.lastTs)) / float64(s.halfLife))
+		s.value = x + (s.value-x)*decay
+	}
+
+	if s.value > 1-ewmaEpsilon {
+		s.value = 1
+	}
+
+	s.lastTs = ts
+
+	return s.value
+}
@@ -21,36 +21,210 @@
 package pulse
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/kobolog/gorb/util"
+)
 
-	log "github.com/Sirupsen/logrus"
+var (
+	errInvalidStep = errors.New("each step must have exactly one of " +
+		"send, send_hex, expect, expect_regex or expect_hex")
 )
 
+// Only this much of the reply is buffered while waiting for a match.
+const maxReplyLength = 64 * 1024
+
+// tcpStep is either a payload to send or a pattern to expect in reply.
+type tcpStep struct {
+	send   []byte
+	expect []byte
+	regexp *regexp.Regexp
+}
+
+func (s tcpStep) isSend() bool {
+	return s.send != nil
+}
+
+// match returns the end offset of the pattern in reply, or -1 if there is
+// no match yet.
+func (s tcpStep) match(reply []byte) int {
+	if s.regexp != nil {
+		if loc := s.regexp.FindIndex(reply); loc != nil {
+			return loc[1]
+		}
+
+		return -1
+	}
+
+	if i := bytes.Index(reply, s.expect); i >= 0 {
+		return i + len(s.expect)
+	}
+
+	return -1
+}
+
+func (s tcpStep) String() string {
+	if s.regexp != nil {
+		return fmt.Sprintf("%q", s.regexp)
+	}
+
+	return fmt.Sprintf("%q", s.expect)
+}
+
 type tcpPulse struct {
 	Driver
 
 	endpoint string
 	dialer   net.Dialer
+	steps    []tcpStep
+	timeout  time.Duration
 }
 
 func newTCPDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+	steps, err := parseSteps(opts["steps"])
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := util.ParseInterval(opts.Get("read_timeout", "5s").(string))
+	if err != nil {
+		return nil, err
+	}
+
 	return &tcpPulse{
 		endpoint: fmt.Sprintf("%s:%d", host, port),
-		dialer:   net.Dialer{DualStack: true, Timeout: 5 * time.Second},
+		dialer:   net.Dialer{DualStack: true},
+		steps:    steps,
+		timeout:  timeout,
 	}, nil
 }
 
-func (p *tcpPulse) Check() StatusType {
-	if socket, err := p.dialer.Dial("tcp", p.endpoint); err != nil {
-		log.Errorf("unable to connect to %s", p.endpoint)
-	} else {
-		socket.Close()
-		return StatusUp
+func (p *tcpPulse) Check(ctx context.Context) Result {
+	socket, err := p.dialer.DialContext(ctx, "tcp", p.endpoint)
+	if err != nil {
+		return failure(ReasonConnection, "unable to connect to %s: %s", p.endpoint, err)
+	}
+
+	defer socket.Close()
+
+	if err := p.converse(ctx, socket); err != nil {
+		return failure(ReasonResponse, "unexpected conversation with %s: %s", p.endpoint, err)
+	}
+
+	return Result{Status: StatusUp}
+}
+
+// converse runs the configured send/expect steps over the connection.
+func (p *tcpPulse) converse(ctx context.Context, socket net.Conn) error {
+	var (
+		reply []byte
+		chunk = make([]byte, 4096)
+	)
+
+	for _, step := range p.steps {
+		deadline := time.Now().Add(p.timeout)
+
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+
+		socket.SetDeadline(deadline)
+
+		if step.isSend() {
+			if _, err := socket.Write(step.send); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		end := step.match(reply)
+
+		for ; end < 0; end = step.match(reply) {
+			if len(reply) >= maxReplyLength {
+				return fmt.Errorf("no match for %s in %d bytes", step, len(reply))
+			}
+
+			n, err := socket.Read(chunk)
+			if err != nil {
+				return fmt.Errorf("no match for %s: %s", step, err)
+			}
+
+			reply = append(reply, chunk[:n]...)
+		}
+
+		// Next expectation is matched against the following data only, which
+		// might have arrived along with this one.
+		reply = reply[end:]
 	}
 
-	return StatusDown
+	return nil
+}
+
+// parseSteps converts a JSON array of steps into a conversation script.
+func parseSteps(v interface{}) ([]tcpStep, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errInvalidStep
+	}
+
+	steps := make([]tcpStep, 0, len(items))
+
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return nil, errInvalidStep
+		}
+
+		for kind, value := range m {
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, errInvalidStep
+			}
+
+			var (
+				step tcpStep
+				err  error
+			)
+
+			switch kind {
+			case "send":
+				step.send = []byte(pattern)
+			case "send_hex":
+				step.send, err = decodeHex(pattern)
+			case "expect":
+				step.expect = []byte(pattern)
+			case "expect_hex":
+				step.expect, err = decodeHex(pattern)
+			case "expect_regex":
+				step.regexp, err = regexp.Compile(pattern)
+			default:
+				return nil, errInvalidStep
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			steps = append(steps, step)
+		}
+	}
+
+	return steps, nil
+}
+
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
 }
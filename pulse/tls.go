@@ -0,0 +1,99 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+)
+
+var (
+	errInvalidCA      = errors.New("no certificates found in the CA bundle")
+	errMissingKeyPair = errors.New("both client certificate and key must be specified")
+)
+
+// newTLSConfig builds a client TLS configuration from pulse arguments:
+// server name for SNI, custom CA bundle, client key pair and whether
+// to skip the server certificate verification altogether.
+func newTLSConfig(host string, opts util.DynamicMap) (*tls.Config, error) {
+	insecure, err := boolArg(opts, "insecure", false)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		ServerName:         opts.Get("server_name", host).(string),
+		InsecureSkipVerify: insecure,
+	}
+
+	if path := opts.Get("ca", "").(string); len(path) != 0 {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errInvalidCA
+		}
+	}
+
+	cert, key := opts.Get("cert", "").(string), opts.Get("key", "").(string)
+
+	switch {
+	case len(cert) != 0 && len(key) != 0:
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{pair}
+	case len(cert) != 0 || len(key) != 0:
+		return nil, errMissingKeyPair
+	}
+
+	return c, nil
+}
+
+// checkExpiry returns an error if the peer certificate has expired and
+// whether it's going to expire within the specified warning window.
+func checkExpiry(state *tls.ConnectionState, window time.Duration) (bool, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return false, nil
+	}
+
+	leaf := state.PeerCertificates[0]
+	left := leaf.NotAfter.Sub(time.Now())
+
+	if left <= 0 {
+		return false, fmt.Errorf("certificate for %s has expired on %s",
+			leaf.Subject.CommonName, leaf.NotAfter)
+	}
+
+	return left < window, nil
+}